@@ -0,0 +1,413 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// AgentSocketEnv names the socket of a running shield agent. When it is set,
+// every Shield command asks the agent to unwrap file keys.
+const AgentSocketEnv = "SHIELD_AGENT_SOCK"
+
+// The agent speaks JSON over a Unix socket, one request and one response per
+// line. It holds unlocked identities in memory until their timeout passes,
+// and never hands them out: clients send a recipient stanza and get back the
+// file key it wraps.
+type agentRequest struct {
+	Op       string  `json:"op"`
+	Name     string  `json:"name,omitempty"`
+	Identity []byte  `json:"identity,omitempty"`
+	Timeout  int64   `json:"timeout,omitempty"`
+	Stanza   *stanza `json:"stanza,omitempty"`
+}
+
+type agentResponse struct {
+	Error   string         `json:"error,omitempty"`
+	NoMatch bool           `json:"no_match,omitempty"`
+	Key     []byte         `json:"key,omitempty"`
+	Keys    []agentKeyInfo `json:"keys,omitempty"`
+}
+
+type agentKeyInfo struct {
+	Name    string    `json:"name"`
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+// agent is the state of a running shield agent.
+type agent struct {
+	mu   sync.Mutex
+	keys map[string]*agentKey
+}
+
+type agentKey struct {
+	identities []Identity
+	expires    time.Time
+	timer      *time.Timer
+}
+
+func handleAgent(args []string) {
+	if len(args) > 0 {
+		switch args[0] {
+		case "add":
+			handleAgentAdd(args[1:])
+			return
+		case "list":
+			handleAgentList()
+			return
+		case "clear":
+			callAgentOrExit(agentRequest{Op: "clear"})
+			colorPrint(Green, "Removed all keys from shield agent")
+			return
+		}
+	}
+
+	fs := flag.NewFlagSet("agent", flag.ExitOnError)
+	socket := fs.String("socket", "", "Listen on this socket (default: $SHIELD_AGENT_SOCK or a private temporary directory)")
+	fs.Usage = func() {
+		fmt.Println("Usage: shield agent [-socket <path>]")
+		fmt.Println("       shield agent add [-t <timeout>] [identity file]...")
+		fmt.Println("       shield agent list")
+		fmt.Println("       shield agent clear")
+		fmt.Println("Runs an agent that keeps unlocked identities in memory, or manages the keys it holds.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	path := *socket
+	if path == "" {
+		path = os.Getenv(AgentSocketEnv)
+	}
+	if path == "" {
+		// A new directory every time, as ssh-agent does. A predictable one
+		// in the shared temporary directory could be created first by
+		// another user, who could then replace the socket.
+		dir, err := os.MkdirTemp("", "shield-agent-")
+		if err != nil {
+			colorPrint(Red, fmt.Sprintf("Error starting shield agent: %s", err))
+			os.Exit(1)
+		}
+		defer os.RemoveAll(dir)
+		path = filepath.Join(dir, "agent.sock")
+	}
+
+	listener, err := listenAgent(path)
+	if err != nil {
+		colorPrint(Red, fmt.Sprintf("Error starting shield agent: %s", err))
+		os.Exit(1)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		listener.Close()
+	}()
+
+	colorPrint(Green, fmt.Sprintf("shield agent listening on %s", path))
+	fmt.Printf("%s=%s; export %s;\n", AgentSocketEnv, path, AgentSocketEnv)
+
+	a := &agent{keys: make(map[string]*agentKey)}
+	a.serve(listener)
+}
+
+// listenAgent listens on path, creating its directory so that only the
+// current user can enter it when it does not exist yet. A socket left behind
+// by an agent that is no longer running is replaced, but anything else at
+// path is left alone.
+func listenAgent(path string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s already exists and is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("an agent is already listening on %s", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+func (a *agent) serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go a.handleConn(conn)
+	}
+}
+
+func (a *agent) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	decoder := json.NewDecoder(conn)
+	encoder := json.NewEncoder(conn)
+	for {
+		var request agentRequest
+		if err := decoder.Decode(&request); err != nil {
+			return
+		}
+		if err := encoder.Encode(a.handle(request)); err != nil {
+			return
+		}
+	}
+}
+
+func (a *agent) handle(request agentRequest) agentResponse {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	switch request.Op {
+	case "add":
+		identities, err := parseIdentities(request.Name, request.Identity)
+		if err != nil {
+			return agentResponse{Error: err.Error()}
+		}
+		if len(identities) == 0 {
+			return agentResponse{Error: fmt.Sprintf("%s holds no identities", request.Name)}
+		}
+
+		a.remove(request.Name)
+		key := &agentKey{identities: identities}
+		if request.Timeout > 0 {
+			timeout := time.Duration(request.Timeout) * time.Second
+			key.expires = time.Now().Add(timeout)
+			name := request.Name
+			key.timer = time.AfterFunc(timeout, func() {
+				a.mu.Lock()
+				defer a.mu.Unlock()
+				if a.keys[name] == key {
+					a.remove(name)
+				}
+			})
+		}
+		a.keys[request.Name] = key
+		return agentResponse{}
+
+	case "unwrap":
+		if request.Stanza == nil {
+			return agentResponse{Error: "missing stanza"}
+		}
+		for _, key := range a.keys {
+			for _, identity := range key.identities {
+				fileKey, err := identity.Unwrap(*request.Stanza)
+				if err == errIncorrectIdentity {
+					continue
+				}
+				if err != nil {
+					return agentResponse{Error: err.Error()}
+				}
+				return agentResponse{Key: fileKey}
+			}
+		}
+		return agentResponse{NoMatch: true}
+
+	case "list":
+		var response agentResponse
+		for name, key := range a.keys {
+			response.Keys = append(response.Keys, agentKeyInfo{Name: name, Expires: key.expires})
+		}
+		sort.Slice(response.Keys, func(i, j int) bool { return response.Keys[i].Name < response.Keys[j].Name })
+		return response
+
+	case "clear":
+		for name := range a.keys {
+			a.remove(name)
+		}
+		return agentResponse{}
+
+	default:
+		return agentResponse{Error: fmt.Sprintf("unknown request: %q", request.Op)}
+	}
+}
+
+// remove forgets a key. The caller holds a.mu.
+func (a *agent) remove(name string) {
+	if key, ok := a.keys[name]; ok {
+		if key.timer != nil {
+			key.timer.Stop()
+		}
+		delete(a.keys, name)
+	}
+}
+
+func handleAgentAdd(args []string) {
+	fs := flag.NewFlagSet("agent add", flag.ExitOnError)
+	timeout := fs.Duration("t", time.Hour, "Forget the keys after this long, 0 to keep them until the agent stops")
+	fs.Usage = func() {
+		fmt.Println("Usage: shield agent add [-t <timeout>] [identity file]...")
+		fmt.Println("Unlocks identities, asking for their passphrase if needed, and adds them to shield agent.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	files := fs.Args()
+	if len(files) == 0 {
+		for _, file := range IdentityFiles {
+			if _, err := os.Stat(file); err == nil {
+				files = append(files, file)
+			}
+		}
+	}
+	if len(files) == 0 {
+		colorPrint(Red, "No identity files found")
+		os.Exit(1)
+	}
+
+	for _, file := range files {
+		content, err := unlockIdentityFile(file)
+		if err != nil {
+			colorPrint(Red, fmt.Sprintf("Error reading %s: %s", file, err))
+			os.Exit(1)
+		}
+
+		name, _ := filepath.Abs(file)
+		callAgentOrExit(agentRequest{Op: "add", Name: name, Identity: content, Timeout: int64(math.Ceil(timeout.Seconds()))})
+
+		if *timeout > 0 {
+			colorPrint(Green, fmt.Sprintf("Added %s to shield agent for %s", file, *timeout))
+		} else {
+			colorPrint(Green, fmt.Sprintf("Added %s to shield agent", file))
+		}
+	}
+}
+
+// unlockIdentityFile returns the contents of an identity file, asking for the
+// passphrase of a protected SSH key on the terminal and decrypting it.
+func unlockIdentityFile(file string) ([]byte, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = parseIdentities(file, content)
+	if !errors.Is(err, errPassphraseProtected) {
+		return content, err
+	}
+
+	tty, err := openTerminal()
+	if err != nil {
+		return nil, fmt.Errorf("no terminal to ask for the passphrase on")
+	}
+	defer tty.Close()
+
+	passphrase, err := tty.readPassword(fmt.Sprintf("Enter passphrase for %s: ", file))
+	if err != nil {
+		return nil, err
+	}
+	key, err := ssh.ParseRawPrivateKeyWithPassphrase(content, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if edKey, ok := key.(*ed25519.PrivateKey); ok {
+		key = *edKey
+	}
+
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(block), nil
+}
+
+func handleAgentList() {
+	response := callAgentOrExit(agentRequest{Op: "list"})
+	if len(response.Keys) == 0 {
+		colorPrint(Yellow, "shield agent holds no keys")
+		return
+	}
+	for _, key := range response.Keys {
+		if key.Expires.IsZero() {
+			fmt.Println(key.Name)
+		} else {
+			fmt.Printf("%s (expires in %s)\n", key.Name, time.Until(key.Expires).Round(time.Second))
+		}
+	}
+}
+
+func callAgentOrExit(request agentRequest) agentResponse {
+	socket := os.Getenv(AgentSocketEnv)
+	if socket == "" {
+		colorPrint(Red, fmt.Sprintf("%s is not set, start shield agent first", AgentSocketEnv))
+		os.Exit(1)
+	}
+
+	response, err := callAgent(socket, request)
+	if err != nil {
+		colorPrint(Red, fmt.Sprintf("shield agent: %s", err))
+		os.Exit(1)
+	}
+	return response
+}
+
+// callAgent sends a single request to the agent listening on socket.
+func callAgent(socket string, request agentRequest) (agentResponse, error) {
+	conn, err := net.DialTimeout("unix", socket, 5*time.Second)
+	if err != nil {
+		return agentResponse{}, err
+	}
+	defer conn.Close()
+
+	if err := json.NewEncoder(conn).Encode(request); err != nil {
+		return agentResponse{}, err
+	}
+	var response agentResponse
+	if err := json.NewDecoder(conn).Decode(&response); err != nil {
+		return agentResponse{}, err
+	}
+	if response.Error != "" {
+		return response, errors.New(response.Error)
+	}
+	return response, nil
+}
+
+// agentIdentity unwraps file keys with the identities held by shield agent.
+type agentIdentity struct {
+	socket string
+}
+
+func (i *agentIdentity) Unwrap(s stanza) ([]byte, error) {
+	response, err := callAgent(i.socket, agentRequest{Op: "unwrap", Stanza: &s})
+	if err != nil {
+		return nil, fmt.Errorf("shield agent: %v", err)
+	}
+	if response.NoMatch {
+		return nil, errIncorrectIdentity
+	}
+	return response.Key, nil
+}
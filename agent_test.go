@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAgent(t *testing.T) {
+	Encryption = "2.0"
+	SetEncryptionTag()
+
+	tmpDir := t.TempDir()
+	SetDirectory(tmpDir)
+	SetIdentityFiles(nil)
+
+	socket := filepath.Join(tmpDir, "agent.sock")
+	listener, err := listenAgent(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go (&agent{keys: make(map[string]*agentKey)}).serve(listener)
+
+	if _, err := listenAgent(socket); err == nil {
+		t.Error("a second agent started on a socket that is in use")
+	}
+
+	// A path that is not a socket, such as a vault file given by mistake, is
+	// never removed to make way for one.
+	vault := filepath.Join(tmpDir, "vault")
+	os.WriteFile(vault, []byte("vault-password"), 0600)
+	if _, err := listenAgent(vault); err == nil {
+		t.Error("an agent started on a regular file")
+	}
+	if content, err := os.ReadFile(vault); err != nil || string(content) != "vault-password" {
+		t.Errorf("the file at the socket path was not left alone: %q, %v", content, err)
+	}
+
+	alice, _ := generateX25519Identity()
+	plaintext := []byte("unlocked once")
+	encrypted, err := encryptContent(plaintext, &Keyring{Recipients: []Recipient{&x25519Recipient{publicKey: alice.publicKey}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(AgentSocketEnv, socket)
+	keyring, err := loadKeyring()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keyring.Identities) != 1 {
+		t.Fatalf("loaded %d identities, want the agent", len(keyring.Identities))
+	}
+
+	if _, err := decryptContent(encrypted, keyring); err == nil {
+		t.Error("decrypted through an agent that holds no keys")
+	}
+
+	if _, err := callAgent(socket, agentRequest{Op: "add", Name: "alice", Identity: []byte(alice.String() + "\n"), Timeout: 3600}); err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err := decryptContent(encrypted, keyring)
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(decrypted, plaintext) {
+		t.Errorf("decrypted %q, want %q", decrypted, plaintext)
+	}
+
+	response, err := callAgent(socket, agentRequest{Op: "list"})
+	if err != nil || len(response.Keys) != 1 || response.Keys[0].Name != "alice" || response.Keys[0].Expires.IsZero() {
+		t.Errorf("listed %+v, %v, want alice with an expiry", response.Keys, err)
+	}
+
+	if _, err := callAgent(socket, agentRequest{Op: "add", Name: "junk", Identity: []byte("not a key")}); err == nil {
+		t.Error("the agent accepted an invalid identity")
+	}
+
+	callAgent(socket, agentRequest{Op: "clear"})
+	if _, err := decryptContent(encrypted, keyring); err == nil {
+		t.Error("decrypted through the agent after its keys were cleared")
+	}
+
+	listener.Close()
+	keyring, err = loadKeyring()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keyring.Identities) != 0 || len(keyring.skippedIdentities) != 1 {
+		t.Errorf("loaded %d identities and skipped %v with the agent stopped", len(keyring.Identities), keyring.skippedIdentities)
+	}
+}
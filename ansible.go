@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Ansible Vault files can be converted to and from Shield files, so the two
+// tools can share secrets while a repository moves from one to the other.
+// Only the current format is supported:
+//
+//	$ANSIBLE_VAULT;1.1;AES256
+//	6638643965...
+//
+// The body is the hex of three lines: the hex of a random salt, of the
+// HMAC-SHA256 of the ciphertext, and of the ciphertext itself. PBKDF2-SHA256
+// stretches the password and salt into an AES-256 key, an HMAC key and the
+// initial counter for AES-CTR, which encrypts the PKCS#7 padded plaintext.
+// Version 1.2 adds a vault ID label to the first line and is otherwise the
+// same.
+
+// AnsibleVaultPasswordFileEnv is Ansible's own variable for its vault
+// password file.
+const AnsibleVaultPasswordFileEnv = "ANSIBLE_VAULT_PASSWORD_FILE"
+
+const (
+	ansibleVaultPrefix     = "$ANSIBLE_VAULT;"
+	ansibleVaultIterations = 10000
+	ansibleVaultSaltSize   = 32
+	ansibleVaultLineWidth  = 80
+)
+
+func handleAnsible(args []string) {
+	if len(args) == 0 {
+		fmt.Println("Usage: shield ansible <import | export> [OPTION]... [file]...")
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "import":
+		handleAnsibleImport(args[1:])
+	case "export":
+		handleAnsibleExport(args[1:])
+	default:
+		colorPrint(Red, fmt.Sprintf("Unknown ansible command: %s", args[0]))
+		os.Exit(1)
+	}
+}
+
+func handleAnsibleImport(args []string) {
+	fs := flag.NewFlagSet("ansible import", flag.ExitOnError)
+	passwordFile := fs.String("vault-password-file", "", "File holding the Ansible Vault password (default: $"+AnsibleVaultPasswordFileEnv+", or ask)")
+	fs.Usage = func() {
+		fmt.Println("Usage: shield ansible import [-vault-password-file <file>] [file]...")
+		fmt.Println("Decrypts Ansible Vault files and encrypts them with Shield. Without files, every")
+		fmt.Println("Ansible Vault file matched by .shield is imported.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	files, err := ansibleFiles(fs.Args())
+	if err != nil {
+		colorPrint(Red, err.Error())
+		os.Exit(1)
+	}
+
+	filesToImport := make(map[*environment][]shieldFile)
+	for _, file := range files {
+		head, err := readFileHead(filepath.Join(directory, file.Path))
+		if err != nil {
+			colorPrint(Red, fmt.Sprintf("Failed to read file: %s", err))
+			os.Exit(1)
+		}
+		if isAnsibleVault(head) {
+			filesToImport[file.Env] = append(filesToImport[file.Env], file)
+		} else if len(fs.Args()) > 0 {
+			colorPrint(Yellow, fmt.Sprintf("Skipped %s, it is not an Ansible Vault file", file.Path))
+		}
+	}
+	if len(filesToImport) == 0 {
+		colorPrint(Yellow, "No Ansible Vault files to import")
+		return
+	}
+
+	resolveVaultPassword()
+	password, err := readAnsibleVaultPassword(*passwordFile, false)
+	if err != nil {
+		colorPrint(Red, err.Error())
+		os.Exit(1)
+	}
+
+	if err := preflightVaultPassword(); err != nil {
+		colorPrint(Red, err.Error())
+		os.Exit(1)
+	}
+	keyring, err := loadKeyring()
+	if err != nil {
+		colorPrint(Red, fmt.Sprintf("Error loading keys: %s", err))
+		os.Exit(1)
+	}
+	for env := range filesToImport {
+		if env.isDefault() && len(keyring.Recipients) == 0 && vaultPasswordMissing() {
+			if err := promptVaultPassword(keyring, true); err != nil {
+				colorPrint(Red, err.Error())
+				os.Exit(1)
+			}
+		}
+	}
+
+	failed := false
+	for env, files := range filesToImport {
+		envKeyring, err := environmentKeyring(keyring, env)
+		if err != nil {
+			colorPrint(Red, err.Error())
+			os.Exit(1)
+		}
+		if envKeyring == nil {
+			colorPrint(Yellow, fmt.Sprintf("No key for environment %s, skipping %d file(s)", env.Name, len(files)))
+			continue
+		}
+
+		for _, file := range files {
+			if err := importAnsibleFile(file, password, envKeyring); err != nil {
+				colorPrint(Red, fmt.Sprintf("Failed to import %s: %s", file.Path, err))
+				failed = true
+				continue
+			}
+			colorPrint(Green, fmt.Sprintf("Imported %s", file.Path))
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func handleAnsibleExport(args []string) {
+	fs := flag.NewFlagSet("ansible export", flag.ExitOnError)
+	passwordFile := fs.String("vault-password-file", "", "File holding the Ansible Vault password (default: $"+AnsibleVaultPasswordFileEnv+", or ask)")
+	vaultID := fs.String("vault-id", "", "Label the files with this vault ID, as ansible-vault --vault-id does")
+	fs.Usage = func() {
+		fmt.Println("Usage: shield ansible export [-vault-password-file <file>] [-vault-id <label>] [file]...")
+		fmt.Println("Decrypts Shield files and encrypts them with Ansible Vault. Without files, every")
+		fmt.Println("encrypted file matched by .shield is exported.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if strings.ContainsAny(*vaultID, ";\r\n") {
+		colorPrint(Red, fmt.Sprintf("Invalid vault ID: %s", *vaultID))
+		os.Exit(1)
+	}
+
+	files, err := ansibleFiles(fs.Args())
+	if err != nil {
+		colorPrint(Red, err.Error())
+		os.Exit(1)
+	}
+
+	var filesToExport []shieldFile
+	environments := make(map[*environment]bool)
+	for _, file := range files {
+		encrypted, err := file.isEncrypted()
+		if err != nil {
+			colorPrint(Red, fmt.Sprintf("Failed to read file: %s", err))
+			os.Exit(1)
+		}
+		if encrypted {
+			filesToExport = append(filesToExport, file)
+			environments[file.Env] = true
+		} else if len(fs.Args()) > 0 {
+			colorPrint(Yellow, fmt.Sprintf("Skipped %s, it is not encrypted with Shield", file.Path))
+		}
+	}
+	if len(filesToExport) == 0 {
+		colorPrint(Yellow, "No Shield files to export")
+		return
+	}
+
+	resolveVaultPassword()
+	password, err := readAnsibleVaultPassword(*passwordFile, true)
+	if err != nil {
+		colorPrint(Red, err.Error())
+		os.Exit(1)
+	}
+
+	if err := preflightVaultPassword(); err != nil {
+		colorPrint(Red, err.Error())
+		os.Exit(1)
+	}
+	keyring, err := loadKeyring()
+	if err != nil {
+		colorPrint(Red, fmt.Sprintf("Error loading keys: %s", err))
+		os.Exit(1)
+	}
+	for env := range environments {
+		if env.isDefault() {
+			if len(keyring.Identities) == 0 && vaultPasswordMissing() {
+				if err := promptVaultPassword(keyring, false); err != nil {
+					colorPrint(Red, err.Error())
+					os.Exit(1)
+				}
+			}
+			continue
+		}
+		envPassword, err := env.password()
+		if err != nil {
+			colorPrint(Red, fmt.Sprintf("Error reading key for environment %s: %s", env.Name, err))
+			os.Exit(1)
+		}
+		if envPassword != nil {
+			keyring.Passwords = append(keyring.Passwords, envPassword)
+		}
+	}
+
+	failed := false
+	for _, file := range filesToExport {
+		err := exportAnsibleFile(file, password, *vaultID, keyring)
+		if errors.Is(err, errNoKey) {
+			colorPrint(Yellow, fmt.Sprintf("Skipped file %s: %s", file.Path, err))
+			continue
+		}
+		if err != nil {
+			colorPrint(Red, fmt.Sprintf("Failed to export %s: %s", file.Path, err))
+			failed = true
+			continue
+		}
+		colorPrint(Green, fmt.Sprintf("Exported %s", file.Path))
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// ansibleFiles returns the files named on the command line, which must be
+// matched by .shield since that decides how they are encrypted, or every file
+// it matches when none are named.
+func ansibleFiles(paths []string) ([]shieldFile, error) {
+	if len(paths) == 0 {
+		return findShieldFiles(), nil
+	}
+
+	rules, err := readShieldConfig()
+	if err != nil {
+		return nil, fmt.Errorf("Error reading .shield file: %v", err)
+	}
+	ignorePatterns, err := readPatternsFromFile(".shieldignore")
+	if err != nil {
+		return nil, fmt.Errorf("Error reading .shieldignore file: %v", err)
+	}
+
+	var files []shieldFile
+	for _, path := range paths {
+		path, err := cleanRepoPath(path)
+		if err != nil {
+			return nil, err
+		}
+		file, ok := matchShieldFile(path, rules, ignorePatterns)
+		if !ok {
+			return nil, fmt.Errorf("%s is not matched by .shield", path)
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// readAnsibleVaultPassword reads the Ansible Vault password from file, or
+// $ANSIBLE_VAULT_PASSWORD_FILE, or asks for it on the terminal. Like Ansible,
+// the whole file is used with surrounding whitespace removed.
+func readAnsibleVaultPassword(file string, confirm bool) ([]byte, error) {
+	if file == "" {
+		file = os.Getenv(AnsibleVaultPasswordFileEnv)
+	}
+	if file != "" {
+		content, err := os.ReadFile(expandHome(file))
+		if err != nil {
+			return nil, fmt.Errorf("error reading Ansible Vault password file: %v", err)
+		}
+		password := bytes.TrimSpace(content)
+		if len(password) == 0 {
+			return nil, fmt.Errorf("the Ansible Vault password file %s is empty", file)
+		}
+		return password, nil
+	}
+
+	tty, err := openTerminal()
+	if err != nil {
+		return nil, fmt.Errorf("%v, pass -vault-password-file or set %s", err, AnsibleVaultPasswordFileEnv)
+	}
+	defer tty.Close()
+
+	password, err := tty.readPassword("Ansible Vault password: ")
+	if err != nil {
+		return nil, fmt.Errorf("error reading Ansible Vault password: %v", err)
+	}
+	if len(password) == 0 {
+		return nil, errors.New("the Ansible Vault password cannot be empty")
+	}
+	if confirm {
+		again, err := tty.readPassword("Confirm Ansible Vault password: ")
+		if err != nil {
+			return nil, fmt.Errorf("error reading Ansible Vault password: %v", err)
+		}
+		if !bytes.Equal(password, again) {
+			return nil, errors.New("the Ansible Vault passwords do not match")
+		}
+	}
+	return password, nil
+}
+
+// importAnsibleFile replaces an Ansible Vault file with a Shield file.
+func importAnsibleFile(file shieldFile, password []byte, keyring *Keyring) error {
+	path := filepath.Join(directory, file.Path)
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	decrypted, err := decryptAnsibleVault(content, password)
+	if err != nil {
+		return err
+	}
+	encrypted, err := encryptFileContent(decrypted, file, keyring)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, encrypted)
+}
+
+// exportAnsibleFile replaces a Shield file with an Ansible Vault file.
+func exportAnsibleFile(file shieldFile, password []byte, vaultID string, keyring *Keyring) error {
+	path := filepath.Join(directory, file.Path)
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	decrypted, err := decryptFileContent(content, file, keyring)
+	if err != nil {
+		return err
+	}
+	encrypted, err := encryptAnsibleVault(decrypted, password, vaultID)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, encrypted)
+}
+
+// isAnsibleVault reports whether content starts like an Ansible Vault file.
+func isAnsibleVault(content []byte) bool {
+	return bytes.HasPrefix(content, []byte(ansibleVaultPrefix))
+}
+
+// encryptAnsibleVault encrypts plaintext as ansible-vault encrypt would, in
+// format 1.2 when vaultID is set and 1.1 otherwise.
+func encryptAnsibleVault(plaintext, password []byte, vaultID string) ([]byte, error) {
+	salt := make([]byte, ansibleVaultSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	cipherKey, hmacKey, iv := ansibleVaultKeys(password, salt)
+
+	block, err := aes.NewCipher(cipherKey)
+	if err != nil {
+		return nil, err
+	}
+	padding := aes.BlockSize - len(plaintext)%aes.BlockSize
+	ciphertext := append(append([]byte{}, plaintext...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	cipher.NewCTR(block, iv).XORKeyStream(ciphertext, ciphertext)
+
+	mac := hmac.New(sha256.New, hmacKey)
+	mac.Write(ciphertext)
+
+	body := hex.EncodeToString([]byte(hex.EncodeToString(salt) + "\n" + hex.EncodeToString(mac.Sum(nil)) + "\n" + hex.EncodeToString(ciphertext)))
+
+	header := ansibleVaultPrefix + "1.1;AES256"
+	if vaultID != "" {
+		header = ansibleVaultPrefix + "1.2;AES256;" + vaultID
+	}
+
+	var out bytes.Buffer
+	out.WriteString(header + "\n")
+	for len(body) > ansibleVaultLineWidth {
+		out.WriteString(body[:ansibleVaultLineWidth] + "\n")
+		body = body[ansibleVaultLineWidth:]
+	}
+	out.WriteString(body + "\n")
+	return out.Bytes(), nil
+}
+
+// decryptAnsibleVault decrypts a file in Ansible Vault format 1.1 or 1.2.
+func decryptAnsibleVault(content, password []byte) ([]byte, error) {
+	lines := strings.Split(strings.ReplaceAll(string(content), "\r\n", "\n"), "\n")
+	header := strings.Split(strings.TrimSpace(lines[0]), ";")
+	if len(header) < 3 || header[0]+";" != ansibleVaultPrefix {
+		return nil, errors.New("not an Ansible Vault file")
+	}
+	if header[1] != "1.1" && header[1] != "1.2" {
+		return nil, fmt.Errorf("unsupported Ansible Vault version: %q", header[1])
+	}
+	if strings.TrimSpace(header[2]) != "AES256" {
+		return nil, fmt.Errorf("unsupported Ansible Vault cipher: %q", header[2])
+	}
+
+	var body strings.Builder
+	for _, line := range lines[1:] {
+		body.WriteString(strings.TrimSpace(line))
+	}
+	decoded, err := hex.DecodeString(body.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid Ansible Vault file: %v", err)
+	}
+	parts := strings.Split(string(decoded), "\n")
+	if len(parts) != 3 {
+		return nil, errors.New("invalid Ansible Vault file")
+	}
+	var salt, expectedMAC, ciphertext []byte
+	for i, part := range []*[]byte{&salt, &expectedMAC, &ciphertext} {
+		if *part, err = hex.DecodeString(parts[i]); err != nil {
+			return nil, fmt.Errorf("invalid Ansible Vault file: %v", err)
+		}
+	}
+
+	cipherKey, hmacKey, iv := ansibleVaultKeys(password, salt)
+	mac := hmac.New(sha256.New, hmacKey)
+	mac.Write(ciphertext)
+	if !hmac.Equal(mac.Sum(nil), expectedMAC) {
+		return nil, errors.New("authentication failed, the file is corrupt or the Ansible Vault password is wrong")
+	}
+
+	block, err := aes.NewCipher(cipherKey)
+	if err != nil {
+		return nil, err
+	}
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCTR(block, iv).XORKeyStream(plaintext, ciphertext)
+
+	if len(plaintext) == 0 || len(plaintext)%aes.BlockSize != 0 {
+		return nil, errors.New("invalid padding in Ansible Vault file")
+	}
+	padding := int(plaintext[len(plaintext)-1])
+	if padding == 0 || padding > aes.BlockSize {
+		return nil, errors.New("invalid padding in Ansible Vault file")
+	}
+	for _, b := range plaintext[len(plaintext)-padding:] {
+		if int(b) != padding {
+			return nil, errors.New("invalid padding in Ansible Vault file")
+		}
+	}
+	return plaintext[:len(plaintext)-padding], nil
+}
+
+// ansibleVaultKeys derives the AES key, HMAC key and initial counter from the
+// password and salt.
+func ansibleVaultKeys(password, salt []byte) ([]byte, []byte, []byte) {
+	derived := pbkdf2.Key(password, salt, ansibleVaultIterations, 2*32+aes.BlockSize, sha256.New)
+	return derived[:32], derived[32:64], derived[64:]
+}
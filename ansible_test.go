@@ -0,0 +1,112 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// ansibleVaultVector was encrypted with the password "ansible-password" and
+// a salt of the bytes 0 to 31, following ansible-vault's format.
+const ansibleVaultVector = `$ANSIBLE_VAULT;1.1;AES256
+30303031303230333034303530363037303830393061306230633064306530663130313131323133
+3134313531363137313831393161316231633164316531660a353339353364393132653564366234
+65623162613464363436636433643935613063366166653734376164616433313764383436336636
+6635353732656634360a313861326132633962633664636465323932656636343033666462633337
+38613238666435633138633866356162343132346664666233616665343236616634376635363039
+3133646663653431653431323865346363653632643838636631
+`
+
+func TestAnsibleVault(t *testing.T) {
+	password := []byte("ansible-password")
+	want := "db_password: hunter2\napi_key: 0123456789abcdef\n"
+
+	decrypted, err := decryptAnsibleVault([]byte(ansibleVaultVector), password)
+	if err != nil || string(decrypted) != want {
+		t.Fatalf("decrypted to %q, %v", decrypted, err)
+	}
+	crlf := strings.ReplaceAll(ansibleVaultVector, "\n", "\r\n")
+	if decrypted, err := decryptAnsibleVault([]byte(crlf), password); err != nil || string(decrypted) != want {
+		t.Errorf("decrypted CRLF file to %q, %v", decrypted, err)
+	}
+	if _, err := decryptAnsibleVault([]byte(ansibleVaultVector), []byte("wrong")); err == nil {
+		t.Error("expected the wrong password to fail")
+	}
+
+	for _, vaultID := range []string{"", "prod"} {
+		for _, plaintext := range []string{"", "x", want, strings.Repeat("0123456789abcdef", 8)} {
+			encrypted, err := encryptAnsibleVault([]byte(plaintext), password, vaultID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.Split(strings.TrimSuffix(string(encrypted), "\n"), "\n")
+			wantHeader := "$ANSIBLE_VAULT;1.1;AES256"
+			if vaultID != "" {
+				wantHeader = "$ANSIBLE_VAULT;1.2;AES256;" + vaultID
+			}
+			if lines[0] != wantHeader {
+				t.Errorf("header %q, want %q", lines[0], wantHeader)
+			}
+			for _, line := range lines[1:] {
+				if len(line) > ansibleVaultLineWidth {
+					t.Errorf("line of %d characters", len(line))
+				}
+			}
+
+			decrypted, err := decryptAnsibleVault(encrypted, password)
+			if err != nil || string(decrypted) != plaintext {
+				t.Errorf("round trip of %q gave %q, %v", plaintext, decrypted, err)
+			}
+		}
+	}
+}
+
+func TestAnsibleImportExport(t *testing.T) {
+	defer useCheapKDF()()
+	Encryption = "2.0"
+	SetEncryptionTag()
+
+	tmpDir := t.TempDir()
+	SetDirectory(tmpDir)
+	os.WriteFile(filepath.Join(tmpDir, ".shield"), []byte("group_vars/*.yml\n"), 0644)
+	os.WriteFile(filepath.Join(tmpDir, ".shieldignore"), []byte(""), 0644)
+	os.MkdirAll(filepath.Join(tmpDir, "group_vars"), os.ModePerm)
+	path := filepath.Join(tmpDir, "group_vars", "all.yml")
+	os.WriteFile(path, []byte(ansibleVaultVector), 0644)
+
+	files, err := ansibleFiles([]string{"group_vars/all.yml"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := files[0]
+
+	// Shield leaves Ansible Vault files alone until they are imported.
+	if needed, _ := needsEncryption(file); needed {
+		t.Error("expected an Ansible Vault file not to need encryption")
+	}
+
+	keyring := passwordKeyring("vault-password")
+	password := []byte("ansible-password")
+	if err := importAnsibleFile(file, password, keyring); err != nil {
+		t.Fatal(err)
+	}
+	content, _ := os.ReadFile(path)
+	decrypted, err := decryptFileContent(content, file, keyring)
+	if err != nil || !strings.Contains(string(decrypted), "hunter2") {
+		t.Fatalf("imported file decrypted to %q, %v", decrypted, err)
+	}
+
+	if err := exportAnsibleFile(file, password, "", keyring); err != nil {
+		t.Fatal(err)
+	}
+	content, _ = os.ReadFile(path)
+	decrypted, err = decryptAnsibleVault(content, password)
+	if err != nil || !strings.Contains(string(decrypted), "hunter2") {
+		t.Errorf("exported file decrypted to %q, %v", decrypted, err)
+	}
+
+	if _, err := ansibleFiles([]string{"inventory.ini"}); err == nil {
+		t.Error("expected a file outside .shield to be refused")
+	}
+}
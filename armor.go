@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+)
+
+// Armored files hold the tagged ciphertext as base64 between a header and a
+// footer, so git and other tools treat them as text:
+//
+//	-----BEGIN SHIELD ENCRYPTED FILE-----
+//	U0hJRUxEWzIuMF06eyJ2ZXJzaW9uIjoiMi4wIiwiY2lwaGVyIjoiYWVzLTI1Ni1nY20i
+//	...
+//	-----END SHIELD ENCRYPTED FILE-----
+const (
+	armorHeader = "-----BEGIN SHIELD ENCRYPTED FILE-----"
+	armorFooter = "-----END SHIELD ENCRYPTED FILE-----"
+
+	// armorLineLength is the number of base64 characters per line, as in PEM.
+	armorLineLength = 64
+)
+
+// armor wraps tagged ciphertext in an armored block.
+func armor(content []byte) []byte {
+	encoded := base64.StdEncoding.EncodeToString(content)
+
+	var buf bytes.Buffer
+	buf.WriteString(armorHeader + "\n")
+	for len(encoded) > armorLineLength {
+		buf.WriteString(encoded[:armorLineLength] + "\n")
+		encoded = encoded[armorLineLength:]
+	}
+	if encoded != "" {
+		buf.WriteString(encoded + "\n")
+	}
+	buf.WriteString(armorFooter + "\n")
+	return buf.Bytes()
+}
+
+// isArmored reports whether content starts with an armor header.
+func isArmored(content []byte) bool {
+	return bytes.HasPrefix(bytes.TrimLeft(content, " \t\r\n"), []byte(armorHeader))
+}
+
+// dearmor returns the tagged ciphertext in an armored block. Line endings and
+// surrounding whitespace are ignored, so a checkout that converted them still
+// decrypts.
+func dearmor(content []byte) ([]byte, error) {
+	content = bytes.TrimSpace(content)
+	if !bytes.HasPrefix(content, []byte(armorHeader)) {
+		return nil, errors.New("missing armor header")
+	}
+	if !bytes.HasSuffix(content, []byte(armorFooter)) {
+		return nil, errors.New("missing armor footer, the file may be truncated")
+	}
+	body := content[len(armorHeader) : len(content)-len(armorFooter)]
+
+	encoded := bytes.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, body)
+
+	decoded, err := base64.StdEncoding.DecodeString(string(encoded))
+	if err != nil {
+		return nil, errors.New("invalid armored data")
+	}
+	if _, _, ok := parseEncryptionTag(decoded); !ok {
+		return nil, errors.New("armored data has no encryption tag")
+	}
+	return decoded, nil
+}
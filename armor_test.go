@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestArmor(t *testing.T) {
+	defer useCheapKDF()()
+	Encryption = "2.0"
+	SetEncryptionTag()
+	keyring := passwordKeyring("vault-password")
+
+	plaintext := bytes.Repeat([]byte("\x00\xffbinary secret\n"), 20)
+	armored, err := encryptFileContent(plaintext, shieldFile{Options: fileOptions{Armor: true}}, keyring)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(armored), "\n"), "\n")
+	if lines[0] != armorHeader || lines[len(lines)-1] != armorFooter {
+		t.Fatalf("missing header or footer:\n%s", armored)
+	}
+	for _, line := range lines[1 : len(lines)-1] {
+		if len(line) > armorLineLength {
+			t.Errorf("line longer than %d characters: %q", armorLineLength, line)
+		}
+	}
+
+	// Armored and raw files decrypt the same way, whatever the pattern says.
+	raw, err := encryptFileContent(plaintext, shieldFile{}, keyring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crlf := bytes.ReplaceAll(armored, []byte("\n"), []byte("\r\n"))
+	for name, content := range map[string][]byte{"armored": armored, "raw": raw, "crlf": crlf} {
+		decrypted, err := decryptFileContent(content, shieldFile{}, keyring)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if !bytes.Equal(decrypted, plaintext) {
+			t.Errorf("%s: decrypted to %q", name, decrypted)
+		}
+	}
+
+	truncated := armored[:len(armored)/2]
+	if _, err := decryptFileContent(truncated, shieldFile{}, keyring); err == nil {
+		t.Error("expected a truncated armored file to fail")
+	}
+
+	if _, err := parseRule("config/*.yaml mode=yaml armor=true"); err == nil {
+		t.Error("expected armor with a mode to be rejected")
+	}
+	if rule, err := parseRule("certs/*.p12 armor=true"); err != nil || !rule.Options.Armor || rule.Pattern != "certs/*.p12" {
+		t.Errorf("parseRule = %+v, %v", rule, err)
+	}
+}
@@ -0,0 +1,506 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Cipher encrypts and decrypts the contents of a file for a single Shield
+// encryption version. The encryption tag is handled by the caller.
+type Cipher interface {
+	Encrypt(plaintext []byte, keyring *Keyring) ([]byte, error)
+	Decrypt(ciphertext []byte, keyring *Keyring) ([]byte, error)
+}
+
+var errNoPassword = errors.New("no vault password available")
+
+// encryptOptions are what a file's pattern in .shield and its path change
+// about how it is encrypted. The zero value encrypts content that is not
+// bound to any file.
+type encryptOptions struct {
+	// path is the file's slash-separated path in the repository, recorded in
+	// the authenticated header.
+	path          string
+	deterministic bool
+	compression   string
+	// cipher names one of aeads, or is empty for the one chosen with
+	// --cipher.
+	cipher string
+}
+
+// cipherName returns the cipher new content is encrypted with.
+func (o encryptOptions) cipherName() string {
+	switch {
+	case o.cipher != "":
+		return o.cipher
+	case CipherName != "":
+		return CipherName
+	default:
+		return DefaultCipher
+	}
+}
+
+// DefaultCipher is the cipher files are encrypted with when neither their
+// pattern in .shield nor --cipher picks another.
+const DefaultCipher = "aes-256-gcm"
+
+// CipherEnv names the cipher to use when --cipher is not given.
+const CipherEnv = "SHIELD_CIPHER"
+
+// aeads are the ciphers file contents can be encrypted with, by the name
+// recorded in the file header. XChaCha20-Poly1305 is much faster than AES on
+// machines without AES instructions, and its nonces are long enough to pick
+// at random without a limit on how many files share a key.
+var aeads = map[string]func(key []byte) (cipher.AEAD, error){
+	"aes-256-gcm":        newGCM,
+	"xchacha20-poly1305": chacha20poly1305.NewX,
+}
+
+func newAEAD(name string, key []byte) (cipher.AEAD, error) {
+	newCipher, ok := aeads[name]
+	if !ok {
+		return nil, fmt.Errorf("unsupported cipher: %q", name)
+	}
+	return newCipher(key)
+}
+
+// checkCipher fails for a header naming a cipher that is not one of aeads,
+// before any work is spent recovering the file key.
+func checkCipher(header fileHeader) error {
+	if _, ok := aeads[header.Cipher]; !ok {
+		return fmt.Errorf("unsupported cipher: %q", header.Cipher)
+	}
+	return nil
+}
+
+// errNoKey is returned when the keyring holds no key for a file.
+var errNoKey = errors.New("no key in the keyring can decrypt this file")
+
+// ciphers maps an encryption version, as written in the SHIELD[x]: tag, to
+// the Cipher that reads and writes it.
+var ciphers = map[string]Cipher{
+	"1.0": legacyCipher{},
+	"2.0": aeadCipher{version: "2.0"},
+	"3.0": streamCipher{version: "3.0"},
+}
+
+func getCipher(version string) (Cipher, error) {
+	c, ok := ciphers[version]
+	if !ok {
+		return nil, fmt.Errorf("unsupported encryption version: %q", version)
+	}
+	return c, nil
+}
+
+// legacyCipher reproduces `openssl enc -aes-256-cbc -nosalt -pass file:...`,
+// which is how SHIELD[1.0] files were written before Shield did its own
+// encryption.
+type legacyCipher struct{}
+
+func (legacyCipher) Encrypt(plaintext []byte, keyring *Keyring) ([]byte, error) {
+	password := keyring.encryptionPassword()
+	if password == nil {
+		return nil, errNoPassword
+	}
+
+	key, iv := evpBytesToKey(password.legacy(), aes.BlockSize)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	padding := aes.BlockSize - len(plaintext)%aes.BlockSize
+	content := append(append([]byte{}, plaintext...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(content, content)
+	return content, nil
+}
+
+// Decrypt uses the vault password, the first in the keyring. SHIELD[1.0]
+// files do not record which key they need, and a wrong key gets past the
+// padding check about one time in 256, so other passwords are not tried: the
+// garbage they produce would be written over the file.
+func (c legacyCipher) Decrypt(ciphertext []byte, keyring *Keyring) ([]byte, error) {
+	password := keyring.encryptionPassword()
+	if password == nil {
+		return nil, errNoPassword
+	}
+	if len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return nil, errors.New("ciphertext is not a multiple of the block size")
+	}
+
+	return c.decrypt(ciphertext, password.legacy())
+}
+
+func (legacyCipher) decrypt(ciphertext, password []byte) ([]byte, error) {
+	key, iv := evpBytesToKey(password, aes.BlockSize)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	content := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(content, ciphertext)
+
+	padding := int(content[len(content)-1])
+	if padding == 0 || padding > aes.BlockSize {
+		return nil, errors.New("bad decrypt")
+	}
+	for _, b := range content[len(content)-padding:] {
+		if int(b) != padding {
+			return nil, errors.New("bad decrypt")
+		}
+	}
+
+	return content[:len(content)-padding], nil
+}
+
+// fileHeader is the JSON line that follows the SHIELD[2.0]: tag. It describes
+// how the rest of the file was encrypted and is authenticated along with it.
+// The file key is either derived from a vault password as described by KDF,
+// or random and wrapped for each of Recipients. Check tells which password
+// derives the key without revealing anything about it, since it depends on
+// the file's own salt. Streamed files record their segment size, and
+// compressed files how the plaintext was compressed before it was encrypted.
+// Path is the file's path in the repository, so a file moved or swapped with
+// another fails to decrypt. Files that are encrypted value by value keep
+// their header in the document instead, with a MAC over the encrypted values.
+type fileHeader struct {
+	Version     string     `json:"version"`
+	Cipher      string     `json:"cipher"`
+	Path        string     `json:"path,omitempty"`
+	KDF         *kdfParams `json:"kdf,omitempty"`
+	Check       []byte     `json:"check,omitempty"`
+	Recipients  []stanza   `json:"recipients,omitempty"`
+	Nonce       []byte     `json:"nonce,omitempty"`
+	Segment     int        `json:"segment,omitempty"`
+	Compression string     `json:"compression,omitempty"`
+	MAC         []byte     `json:"mac,omitempty"`
+}
+
+// kdfParams describes how the file key was derived from the vault password.
+// They are stored in every file, so the defaults can be raised without
+// breaking files encrypted with older settings.
+type kdfParams struct {
+	Name    string `json:"name"`
+	Salt    []byte `json:"salt"`
+	Time    uint32 `json:"time"`
+	Memory  uint32 `json:"memory"`
+	Threads uint8  `json:"threads"`
+}
+
+// defaultKDFParams are used for newly encrypted files. Memory is in KiB.
+var defaultKDFParams = kdfParams{
+	Name:    "argon2id",
+	Time:    3,
+	Memory:  64 * 1024,
+	Threads: 4,
+}
+
+// Upper bounds on KDF parameters read from a file header, so a crafted file
+// cannot make decryption allocate unbounded memory or run forever.
+const (
+	maxKDFTime   = 64
+	maxKDFMemory = 4 * 1024 * 1024
+)
+
+func newKDFParams() (kdfParams, error) {
+	params := defaultKDFParams
+	params.Salt = make([]byte, 16)
+	if _, err := rand.Read(params.Salt); err != nil {
+		return kdfParams{}, err
+	}
+	return params, nil
+}
+
+func deriveKey(password []byte, params kdfParams) ([]byte, error) {
+	switch params.Name {
+	case "argon2id":
+		if params.Time == 0 || params.Time > maxKDFTime || params.Memory == 0 || params.Memory > maxKDFMemory || params.Threads == 0 {
+			return nil, errors.New("invalid argon2id parameters in file header")
+		}
+		if len(params.Salt) < 16 {
+			return nil, errors.New("salt in file header is too short")
+		}
+		return argon2.IDKey(password, params.Salt, params.Time, params.Memory, params.Threads, 32), nil
+	default:
+		return nil, fmt.Errorf("unsupported key derivation function: %q", params.Name)
+	}
+}
+
+// aeadCipher writes a JSON header line followed by ciphertext, from the
+// cipher named in the header.
+// The tag and header are passed as additional data, so any change to the file
+// makes decryption fail instead of producing garbage.
+type aeadCipher struct {
+	version string
+}
+
+func (c aeadCipher) Encrypt(plaintext []byte, keyring *Keyring) ([]byte, error) {
+	return c.encrypt(plaintext, keyring, encryptOptions{})
+}
+
+// encrypt picks a random salt and nonce, or derives them for deterministic
+// files. The plaintext is compressed first when opts set a compression,
+// unless it looks compressed already or would not get any smaller.
+func (c aeadCipher) encrypt(plaintext []byte, keyring *Keyring, opts encryptOptions) ([]byte, error) {
+	header := fileHeader{Version: c.version, Cipher: opts.cipherName(), Path: opts.path}
+	if err := checkCipher(header); err != nil {
+		return nil, err
+	}
+	if name := chooseCompression(opts.compression, plaintext); name != "" {
+		compressed, ok, err := compressBytes(name, plaintext)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			header.Compression, plaintext = name, compressed
+		}
+	}
+
+	key, err := newFileKey(&header, keyring, opts)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(header.Cipher, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.deterministic {
+		header.Nonce = sivNonce(key, aead.NonceSize(), []byte(c.version), plaintext)
+	} else {
+		header.Nonce = make([]byte, aead.NonceSize())
+		if _, err := rand.Read(header.Nonce); err != nil {
+			return nil, err
+		}
+	}
+
+	encodedHeader, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	encodedHeader = append(encodedHeader, '\n')
+
+	return aead.Seal(encodedHeader, header.Nonce, plaintext, c.additionalData(encodedHeader)), nil
+}
+
+func (c aeadCipher) Decrypt(ciphertext []byte, keyring *Keyring) ([]byte, error) {
+	return c.decrypt(ciphertext, keyring, "")
+}
+
+// decrypt fails when the file was encrypted for a path other than path,
+// unless path is empty.
+func (c aeadCipher) decrypt(ciphertext []byte, keyring *Keyring, path string) ([]byte, error) {
+	end := bytes.IndexByte(ciphertext, '\n')
+	if end < 0 {
+		return nil, errors.New("missing file header")
+	}
+	encodedHeader, ciphertext := ciphertext[:end+1], ciphertext[end+1:]
+
+	var header fileHeader
+	if err := json.Unmarshal(encodedHeader, &header); err != nil {
+		return nil, fmt.Errorf("invalid file header: %v", err)
+	}
+	if header.Version != c.version {
+		return nil, fmt.Errorf("file header version %q does not match its tag", header.Version)
+	}
+	if err := checkCipher(header); err != nil {
+		return nil, err
+	}
+	if err := checkPath(header, path); err != nil {
+		return nil, err
+	}
+
+	key, err := fileKey(header, keyring)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(header.Cipher, key)
+	if err != nil {
+		return nil, err
+	}
+	if len(header.Nonce) != aead.NonceSize() {
+		return nil, errors.New("invalid nonce in file header")
+	}
+
+	plaintext, err := aead.Open(nil, header.Nonce, ciphertext, c.additionalData(encodedHeader))
+	if err != nil {
+		return nil, errors.New("authentication failed, the file is corrupt or the key is wrong")
+	}
+	if header.Compression != "" {
+		if plaintext, err = decompressBytes(header.Compression, plaintext); err != nil {
+			return nil, fmt.Errorf("failed to decompress: %v", err)
+		}
+	}
+	return plaintext, nil
+}
+
+func (c aeadCipher) additionalData(encodedHeader []byte) []byte {
+	return append([]byte("SHIELD["+c.version+"]:"), encodedHeader...)
+}
+
+// newFileKey picks the key for a new file and records in header how to
+// recover it: a random key wrapped for each recipient when there are any, or
+// a key derived from the vault password otherwise. For deterministic files, the
+// salt is derived from the file's path rather than random.
+func newFileKey(header *fileHeader, keyring *Keyring, opts encryptOptions) ([]byte, error) {
+	switch {
+	case len(keyring.Recipients) > 0:
+		if opts.deterministic {
+			return nil, errDeterministicRecipients
+		}
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		for _, recipient := range keyring.Recipients {
+			s, err := recipient.Wrap(key)
+			if err != nil {
+				return nil, err
+			}
+			header.Recipients = append(header.Recipients, s)
+		}
+		return key, nil
+	case keyring.encryptionPassword() != nil:
+		password := keyring.encryptionPassword()
+		params, err := newKDFParams()
+		if err != nil {
+			return nil, err
+		}
+		if opts.deterministic {
+			params.Salt = sivSalt(opts.path)
+		}
+		key, err := deriveKey(password.Secret, params)
+		if err != nil {
+			return nil, err
+		}
+		header.KDF = &params
+		header.Check = keyCheck(key)
+		return key, nil
+	default:
+		return nil, errNoPassword
+	}
+}
+
+// fileKey recovers the key a file was encrypted with, from the vault password
+// or by unwrapping one of the recipient stanzas with a local identity.
+func fileKey(header fileHeader, keyring *Keyring) ([]byte, error) {
+	if header.KDF != nil {
+		for _, password := range keyring.Passwords {
+			key, err := deriveKey(password.Secret, *header.KDF)
+			if err != nil {
+				return nil, err
+			}
+			if hmac.Equal(keyCheck(key), header.Check) {
+				return key, nil
+			}
+		}
+		return nil, fmt.Errorf("%w (no vault password in the keyring matches)", errNoKey)
+	}
+
+	for _, s := range header.Recipients {
+		for _, identity := range keyring.Identities {
+			key, err := identity.Unwrap(s)
+			if err == errIncorrectIdentity {
+				continue
+			}
+			return key, err
+		}
+	}
+	if len(keyring.skippedIdentities) > 0 {
+		return nil, fmt.Errorf("%w (no identity matches its recipients, skipped %s)", errNoKey, strings.Join(keyring.skippedIdentities, "; "))
+	}
+	return nil, fmt.Errorf("%w (no identity matches its recipients)", errNoKey)
+}
+
+// keyCheck identifies the password a file key was derived from. It is
+// derived from the key, so testing a guessed password against it costs a
+// full key derivation with the file's own salt.
+func keyCheck(key []byte) []byte {
+	return fieldSubkey(key, "shield key check")[:8]
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// evpBytesToKey is OpenSSL's EVP_BytesToKey with SHA-256, one iteration and
+// no salt, returning a 32 byte AES key and an IV of ivLen bytes.
+func evpBytesToKey(password []byte, ivLen int) ([]byte, []byte) {
+	var derived, block []byte
+	for len(derived) < 32+ivLen {
+		h := sha256.New()
+		h.Write(block)
+		h.Write(password)
+		block = h.Sum(nil)
+		derived = append(derived, block...)
+	}
+	return derived[:32], derived[32 : 32+ivLen]
+}
+
+// writeFileAtomic writes content to a temporary file next to path and renames
+// it into place, so path never holds a partially written file.
+func writeFileAtomic(path string, content []byte) error {
+	return writeFileAtomicFunc(path, func(w io.Writer) error {
+		_, err := w.Write(content)
+		return err
+	})
+}
+
+// writeFileAtomicFunc is writeFileAtomic for content produced by write. When
+// write fails, path is left untouched.
+func writeFileAtomicFunc(path string, write func(w io.Writer) error) error {
+	perm := os.FileMode(0666)
+	if info, err := os.Stat(path); err == nil {
+		perm = info.Mode().Perm()
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".shield-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	buffered := bufio.NewWriter(tmp)
+	if err := write(buffered); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := buffered.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
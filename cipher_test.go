@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLegacyCipher(t *testing.T) {
+	// Produced by `openssl enc -aes-256-cbc -nosalt -pass file:...` with the
+	// password "broy", as written by Shield before it encrypted natively.
+	vectors := []struct {
+		plaintext  string
+		ciphertext string
+	}{
+		{"test", "56a818385e0931ad266cbc2b340935af"},
+		{"hello shield\nsecond line\n", "b5972bc9c3bb264c5bcc2c508cb3c0ae053a76f946e38275dbfbaf8cc99db5e1"},
+	}
+
+	c, err := getCipher("1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range vectors {
+		ciphertext, _ := hex.DecodeString(v.ciphertext)
+
+		decrypted, err := c.Decrypt(ciphertext, passwordKeyring("broy"))
+		if err != nil {
+			t.Errorf("failed to decrypt %q: %v", v.plaintext, err)
+		} else if string(decrypted) != v.plaintext {
+			t.Errorf("decrypted %q, want %q", decrypted, v.plaintext)
+		}
+
+		encrypted, err := c.Encrypt([]byte(v.plaintext), passwordKeyring("broy"))
+		if err != nil {
+			t.Errorf("failed to encrypt %q: %v", v.plaintext, err)
+		} else if !bytes.Equal(encrypted, ciphertext) {
+			t.Errorf("encrypted %q to %x, want %s", v.plaintext, encrypted, v.ciphertext)
+		}
+	}
+
+	if _, err := c.Decrypt([]byte("0123456789abcdef"), passwordKeyring("broy")); err == nil {
+		t.Error("expected garbage ciphertext to fail decryption")
+	}
+
+	// Only the vault password is tried, since a wrong one can get past the
+	// padding check.
+	keyring := passwordKeyring("other")
+	keyring.Passwords = append(keyring.Passwords, newPassword("old", []byte("broy")))
+	ciphertext, _ := hex.DecodeString(vectors[1].ciphertext)
+	if decrypted, err := c.Decrypt(ciphertext, keyring); err == nil && string(decrypted) == vectors[1].plaintext {
+		t.Error("expected a password other than the vault password not to be tried")
+	}
+
+	// openssl keeps the \r of a password file with Windows line endings, so
+	// "test" encrypted with "broy\r\n" in the file needs the \r to decrypt.
+	// Newer formats drop it.
+	file := filepath.Join(t.TempDir(), "vault")
+	os.WriteFile(file, []byte("broy\r\n"), 0600)
+	password, err := readPasswordEntry("vault", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(password.Secret) != "broy" {
+		t.Errorf("read %q from a file with Windows line endings, want %q", password.Secret, "broy")
+	}
+	ciphertext, _ = hex.DecodeString("8b7af6e9c57a25b7d9ce0e826f556235")
+	if decrypted, err := c.Decrypt(ciphertext, &Keyring{Passwords: []*Password{password}}); err != nil || string(decrypted) != "test" {
+		t.Errorf("decrypted %q, %v with a password file with Windows line endings", decrypted, err)
+	}
+}
+
+func TestAEADCipher(t *testing.T) {
+	defer useCheapKDF()()
+
+	c, err := getCipher("2.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	broy := passwordKeyring("broy")
+
+	plaintext := []byte("hello shield\n")
+	encrypted, err := c.Encrypt(plaintext, broy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	again, err := c.Encrypt(plaintext, broy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(encrypted, again) {
+		t.Error("encrypting twice produced identical ciphertext")
+	}
+
+	decrypted, err := c.Decrypt(encrypted, broy)
+	if err != nil {
+		t.Fatalf("failed to decrypt: %v", err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Errorf("decrypted %q, want %q", decrypted, plaintext)
+	}
+
+	// Files record a check of the key they need, so the right password is
+	// picked from a keyring holding several.
+	keyring := passwordKeyring("other")
+	keyring.Passwords = append(keyring.Passwords, broy.Passwords...)
+	if _, err := c.Decrypt(encrypted, keyring); err != nil {
+		t.Errorf("failed to decrypt with a keyring: %v", err)
+	}
+	if _, err := c.Decrypt(encrypted, passwordKeyring("wrong")); !errors.Is(err, errNoKey) {
+		t.Errorf("expected a missing key to be reported, got %v", err)
+	}
+
+	// Files keep the KDF parameters they were written with.
+	defaultKDFParams.Time++
+	if _, err := c.Decrypt(encrypted, broy); err != nil {
+		t.Errorf("failed to decrypt after raising the KDF defaults: %v", err)
+	}
+
+	if _, err := c.Decrypt(encrypted, passwordKeyring("wrong")); err == nil {
+		t.Error("expected decryption with the wrong password to fail")
+	}
+
+	for i := range encrypted {
+		tampered := append([]byte{}, encrypted...)
+		tampered[i] ^= 0x01
+		if _, err := c.Decrypt(tampered, broy); err == nil {
+			t.Errorf("flipping byte %d was not detected", i)
+		}
+	}
+}
+
+func TestKeyCheck(t *testing.T) {
+	defer useCheapKDF()()
+	defer useEncryption("2.0")()
+
+	// Files name their password only with a check that depends on their own
+	// salt, so nothing in one file helps to attack another.
+	var checks [][]byte
+	for i := 0; i < 2; i++ {
+		encrypted, err := encryptContent([]byte("secret"), passwordKeyring("broy"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		checks = append(checks, readTestHeader(t, encrypted).Check)
+	}
+	if len(checks[0]) == 0 || bytes.Equal(checks[0], checks[1]) {
+		t.Errorf("expected a different key check in each file, got %x and %x", checks[0], checks[1])
+	}
+}
+
+// useCheapKDF lowers the Argon2id cost for tests that derive many keys and
+// returns a function that restores the defaults.
+func useCheapKDF() func() {
+	saved := defaultKDFParams
+	defaultKDFParams.Time = 1
+	defaultKDFParams.Memory = 64
+	defaultKDFParams.Threads = 1
+	return func() { defaultKDFParams = saved }
+}
+
+// useEncryption switches to an encryption version and returns a function
+// that switches back to the one before.
+func useEncryption(version string) func() {
+	saved := Encryption
+	Encryption = version
+	SetEncryptionTag()
+	return func() {
+		Encryption = saved
+		SetEncryptionTag()
+	}
+}
+
+// encryptContent encrypts content as a file without options would be.
+func encryptContent(content []byte, keyring *Keyring) ([]byte, error) {
+	return encryptContentWith(content, keyring, encryptOptions{})
+}
+
+// decryptContent decrypts content encrypted for any path.
+func decryptContent(content []byte, keyring *Keyring) ([]byte, error) {
+	return decryptContentAt(content, keyring, "")
+}
+
+// passwordKeyring returns a keyring holding a single vault password.
+func passwordKeyring(secret string) *Keyring {
+	return &Keyring{Passwords: []*Password{newPassword("test", []byte(secret))}}
+}
+
+func TestCipherOption(t *testing.T) {
+	defer useCheapKDF()()
+	defer SetCipherName("")
+	keyring := passwordKeyring("broy")
+
+	tests := []struct {
+		version string
+		options fileOptions
+		content string
+	}{
+		{"2.0", fileOptions{}, "secret"},
+		{"3.0", fileOptions{}, "secret"},
+		{"3.0", fileOptions{Compress: "zstd"}, strings.Repeat("compressible ", 100)},
+		{"2.0", fileOptions{Deterministic: true}, "secret"},
+		{"2.0", fileOptions{Mode: "yaml"}, "password: hunter2\n"},
+	}
+	for _, tt := range tests {
+		Encryption = tt.version
+		SetEncryptionTag()
+
+		for name := range aeads {
+			// Pick the cipher through .shield and through --cipher.
+			for _, fromFlag := range []bool{false, true} {
+				options := tt.options
+				SetCipherName("")
+				if fromFlag {
+					SetCipherName(name)
+				} else {
+					options.Cipher = name
+				}
+				file := shieldFile{Path: "secrets/app", Options: options}
+
+				encrypted, err := encryptFileContent([]byte(tt.content), file, keyring)
+				if err != nil {
+					t.Fatalf("%s %s %+v: %v", tt.version, name, options, err)
+				}
+
+				// The header names the cipher, so files decrypt whatever is
+				// chosen for new ones.
+				SetCipherName("")
+				file.Options.Cipher = ""
+				decrypted, err := decryptFileContent(encrypted, file, keyring)
+				if err != nil || string(decrypted) != tt.content {
+					t.Errorf("%s %s %+v: decrypted to %q, %v", tt.version, name, options, decrypted, err)
+				}
+
+				if tt.options.Mode == "" {
+					if header := readTestHeader(t, encrypted); header.Cipher != name {
+						t.Errorf("%s %s: header names cipher %q", tt.version, name, header.Cipher)
+					}
+				}
+			}
+		}
+	}
+
+	if _, err := parseRule("media/** cipher=rot13"); err == nil {
+		t.Error("expected an unknown cipher to be rejected")
+	}
+	if rule, _ := parseRule("media/** cipher=xchacha20-poly1305"); rule.Pattern != "media/**" || rule.Options.Cipher != "xchacha20-poly1305" {
+		t.Errorf("unexpected rule: %+v", rule)
+	}
+}
+
+func TestDefaultEncryption(t *testing.T) {
+	defer useCheapKDF()()
+
+	// Builds without -X main.Encryption use the current version.
+	defer useEncryption("")()
+	encrypted, err := encryptContent([]byte("secret"), passwordKeyring("broy"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version, _, _ := parseEncryptionTag(encrypted); version != CurrentEncryption {
+		t.Errorf("encrypted with %q, want %q", version, CurrentEncryption)
+	}
+
+	content, err := os.ReadFile("version.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var release struct {
+		Encryption string `json:"encryption"`
+	}
+	if err := json.Unmarshal(content, &release); err != nil {
+		t.Fatal(err)
+	}
+	if release.Encryption != CurrentEncryption {
+		t.Errorf("version.json has encryption %q, but CurrentEncryption is %q", release.Encryption, CurrentEncryption)
+	}
+}
+
+func readTestHeader(t *testing.T, encrypted []byte) fileHeader {
+	t.Helper()
+	_, rest, _ := parseEncryptionTag(encrypted)
+	line := rest[:bytes.IndexByte(rest, '\n')]
+	var header fileHeader
+	if err := json.NewDecoder(strings.NewReader(string(line))).Decode(&header); err != nil {
+		t.Fatal(err)
+	}
+	return header
+}
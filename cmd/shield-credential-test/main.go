@@ -0,0 +1,60 @@
+// shield-credential-test is a credential helper for exercising Shield's
+// credential helper protocol without a real secret store. It answers get
+// requests from a file of key=password lines named by
+// SHIELD_CREDENTIAL_TEST_FILE.
+//
+// Build it onto the PATH and run Shield with --credential-helper test:
+//
+//	go build -o ~/bin/ ./cmd/shield-credential-test
+//	echo vault=correct-horse > /tmp/credentials
+//	SHIELD_CREDENTIAL_TEST_FILE=/tmp/credentials shield --credential-helper test -d
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+func main() {
+	if len(os.Args) != 2 || os.Args[1] != "get" {
+		fmt.Fprintln(os.Stderr, "Usage: shield-credential-test get")
+		os.Exit(1)
+	}
+
+	request := readPairs(bufio.NewScanner(os.Stdin))
+
+	file := os.Getenv("SHIELD_CREDENTIAL_TEST_FILE")
+	if file == "" {
+		fmt.Fprintln(os.Stderr, "SHIELD_CREDENTIAL_TEST_FILE is not set")
+		os.Exit(1)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer f.Close()
+
+	credentials := readPairs(bufio.NewScanner(f))
+	if password, ok := credentials[request["key"]]; ok {
+		fmt.Printf("password=%s\n", password)
+	}
+	fmt.Println()
+}
+
+// readPairs reads key=value lines up to the first blank line.
+func readPairs(scanner *bufio.Scanner) map[string]string {
+	pairs := make(map[string]string)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			break
+		}
+		if key, value, ok := strings.Cut(line, "="); ok {
+			pairs[key] = value
+		}
+	}
+	return pairs
+}
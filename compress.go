@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Files matched by a pattern with compress=zstd or compress=gzip are
+// compressed before they are encrypted, since ciphertext does not compress in
+// git packs. The compression is recorded in the file header, so decryption
+// needs no option.
+
+// compression compresses and decompresses plaintext.
+type compression struct {
+	newWriter func(w io.Writer) (io.WriteCloser, error)
+	newReader func(r io.Reader) (io.ReadCloser, error)
+}
+
+var compressions = map[string]compression{
+	"gzip": {
+		newWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	},
+	"zstd": {
+		newWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true))
+			if err != nil {
+				return nil, err
+			}
+			return decoder.IOReadCloser(), nil
+		},
+	},
+}
+
+func getCompression(name string) (compression, error) {
+	c, ok := compressions[name]
+	if !ok {
+		return compression{}, fmt.Errorf("unsupported compression: %q", name)
+	}
+	return c, nil
+}
+
+// compressedSignatures are the magic numbers of formats that are compressed
+// already, so compressing them again would only cost time.
+var compressedSignatures = [][]byte{
+	{0x1f, 0x8b},                       // gzip
+	{0x28, 0xb5, 0x2f, 0xfd},           // zstd
+	{0xfd, '7', 'z', 'X', 'Z', 0x00},   // xz
+	[]byte("BZh"),                      // bzip2
+	{0x04, 0x22, 0x4d, 0x18},           // lz4
+	[]byte("PK\x03\x04"),               // zip, and jar, docx and friends
+	{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c}, // 7z
+	[]byte("Rar!\x1a\x07"),             // rar
+	[]byte("\x89PNG\r\n\x1a\n"),        // png
+	{0xff, 0xd8, 0xff},                 // jpeg
+	[]byte("GIF8"),                     // gif
+	[]byte("OggS"),                     // ogg
+	[]byte("ID3"),                      // mp3
+	[]byte("wOF2"),                     // woff2
+}
+
+// isCompressed reports whether content, or the start of it, looks like a
+// format that is compressed already.
+func isCompressed(head []byte) bool {
+	for _, signature := range compressedSignatures {
+		if bytes.HasPrefix(head, signature) {
+			return true
+		}
+	}
+	// WebP, and the MP4 family with its ftyp box.
+	if len(head) >= 12 && (bytes.Equal(head[:4], []byte("RIFF")) && bytes.Equal(head[8:12], []byte("WEBP")) || bytes.Equal(head[4:8], []byte("ftyp"))) {
+		return true
+	}
+	return false
+}
+
+// chooseCompression returns the compression to use for content that starts
+// with head, or "" when it is empty or compressed already. Content in a format
+// that isn't recognised is judged by how well its start compresses, which
+// also catches random data such as other ciphertext.
+func chooseCompression(name string, head []byte) string {
+	if len(head) > fileHeadSize {
+		head = head[:fileHeadSize]
+	}
+	if name == "" || len(head) == 0 || isCompressed(head) {
+		return ""
+	}
+
+	if len(head) >= fileHeadSize/4 {
+		var buf bytes.Buffer
+		w, _ := flate.NewWriter(&buf, flate.BestSpeed)
+		w.Write(head)
+		w.Close()
+		if buf.Len() > len(head)*9/10 {
+			return ""
+		}
+	}
+	return name
+}
+
+// compressBytes compresses content in memory. It reports false when that
+// does not make it any smaller.
+func compressBytes(name string, content []byte) ([]byte, bool, error) {
+	c, err := getCompression(name)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var buf bytes.Buffer
+	w, err := c.newWriter(&buf)
+	if err != nil {
+		return nil, false, err
+	}
+	if _, err := w.Write(content); err != nil {
+		return nil, false, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, false, err
+	}
+	if buf.Len() >= len(content) {
+		return nil, false, nil
+	}
+	return buf.Bytes(), true, nil
+}
+
+func decompressBytes(name string, content []byte) ([]byte, error) {
+	c, err := getCompression(name)
+	if err != nil {
+		return nil, err
+	}
+	r, err := c.newReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestCompression(t *testing.T) {
+	defer useCheapKDF()()
+	keyring := passwordKeyring("vault-password")
+	defer useEncryption(Encryption)()
+
+	dump := bytes.Repeat([]byte("INSERT INTO users VALUES (1, 'alice@example.com');\n"), 10000)
+	random := make([]byte, 100000)
+	rand.Read(random)
+	gzipped, _, _ := compressBytes("gzip", dump)
+
+	for _, version := range []string{"2.0", "3.0"} {
+		Encryption = version
+		SetEncryptionTag()
+
+		for _, name := range []string{"gzip", "zstd"} {
+			file := shieldFile{Path: "dump.sql", Options: fileOptions{Compress: name}}
+
+			tests := []struct {
+				content    []byte
+				compressed bool
+			}{
+				{dump, true},
+				// Already compressed, by its magic number or in effect.
+				{gzipped, false},
+				{random, false},
+				{nil, false},
+			}
+			for i, tt := range tests {
+				encrypted, err := encryptFileContent(tt.content, file, keyring)
+				if err != nil {
+					t.Fatalf("%s %s #%d: %v", version, name, i, err)
+				}
+				header := readTestHeader(t, encrypted)
+				if got := header.Compression != ""; got != tt.compressed {
+					t.Errorf("%s %s #%d: compression %q, want compressed %v", version, name, i, header.Compression, tt.compressed)
+				}
+				if tt.compressed && len(encrypted) > len(tt.content)/5 {
+					t.Errorf("%s %s #%d: %d bytes encrypted to %d", version, name, i, len(tt.content), len(encrypted))
+				}
+
+				decrypted, err := decryptFileContent(encrypted, shieldFile{}, keyring)
+				if err != nil {
+					t.Fatalf("%s %s #%d: %v", version, name, i, err)
+				}
+				if !bytes.Equal(decrypted, tt.content) {
+					t.Errorf("%s %s #%d: decrypted content does not match", version, name, i)
+				}
+			}
+		}
+	}
+
+	if _, err := parseRule("dumps/*.sql compress=lzma"); err == nil {
+		t.Error("expected an unknown compression to be rejected")
+	}
+	if _, err := parseRule("config.yaml mode=yaml compress=zstd"); err == nil {
+		t.Error("expected compress with a mode to be rejected")
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// DefaultEnvironment holds the patterns in .shield that come before any
+// [environment] section. It uses the vault password and recipients.
+const DefaultEnvironment = "default"
+
+// environment is a named section of .shield whose files share a key, so that
+// for example dev, staging and prod secrets can live in one repository:
+//
+//	*.secret
+//
+//	[prod]
+//	secrets/prod/**
+//
+//	[staging key=~/.ssh/staging-vault]
+//	secrets/staging/**
+//
+// An environment's key defaults to the keyring entry with the same name.
+type environment struct {
+	Name    string
+	KeyFile string
+}
+
+// fileOptions are set per pattern in .shield, after the pattern:
+//
+//	config/*.yaml mode=yaml
+//	certs/*.p12 armor=true
+//	.env deterministic=true
+//	dumps/*.sql compress=zstd
+//	media/** cipher=xchacha20-poly1305
+type fileOptions struct {
+	// Mode encrypts a structured or .env file value by value instead of as a
+	// whole. It names one of fieldModes, or is empty.
+	Mode string
+	// Armor writes whole encrypted files as base64 text.
+	Armor bool
+	// Deterministic gives the same ciphertext for the same plaintext, key
+	// and path, at the cost of revealing when two versions are equal.
+	Deterministic bool
+	// Compress names one of compressions to compress whole files with before
+	// they are encrypted, or is empty.
+	Compress string
+	// Cipher names one of aeads to encrypt files with, or is empty for the
+	// one chosen with --cipher.
+	Cipher string
+}
+
+// shieldRule is a single pattern from .shield and the environment it is in.
+type shieldRule struct {
+	Pattern string
+	Env     *environment
+	Options fileOptions
+}
+
+// shieldFile is a file matched by .shield.
+type shieldFile struct {
+	Path    string
+	Env     *environment
+	Options fileOptions
+}
+
+// encryptOptions binds the file to its path and applies its pattern's options.
+func (f shieldFile) encryptOptions() encryptOptions {
+	return encryptOptions{
+		path:          filepath.ToSlash(f.Path),
+		deterministic: f.Options.Deterministic,
+		compression:   f.Options.Compress,
+		cipher:        f.Options.Cipher,
+	}
+}
+
+func (e *environment) isDefault() bool {
+	return e.Name == DefaultEnvironment
+}
+
+// password reads the environment's key, asking the credential helper when
+// there is no key file. It returns nil without an error when the key is not
+// available on this machine.
+func (e *environment) password() (*Password, error) {
+	keyFile := e.KeyFile
+	if keyFile == "" {
+		keyFile = filepath.Join(KeyringDirectory, e.Name)
+	}
+
+	password, err := readPasswordEntry(e.Name, keyFile)
+	if os.IsNotExist(err) && CredentialHelper != "" {
+		secret, err := getCredential(e.Name)
+		if secret == nil || err != nil {
+			return nil, err
+		}
+		if err := checkPassword(fmt.Sprintf("the key for environment %s", e.Name), secret); err != nil {
+			return nil, err
+		}
+		return newPassword(e.Name, secret), nil
+	}
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return password, err
+}
+
+// readShieldConfig reads the patterns and environments from .shield. Blank
+// lines and lines starting with # are ignored.
+func readShieldConfig() ([]shieldRule, error) {
+	f, err := os.Open(filepath.Join(directory, ".shield"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	env := &environment{Name: DefaultEnvironment}
+	environments := map[string]*environment{env.Name: env}
+
+	var rules []shieldRule
+	scanner := bufio.NewScanner(f)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf(".shield:%d: unterminated environment section", lineNumber)
+			}
+			env, err = parseEnvironment(strings.Fields(line[1:len(line)-1]), environments)
+			if err != nil {
+				return nil, fmt.Errorf(".shield:%d: %v", lineNumber, err)
+			}
+			continue
+		}
+
+		rule, err := parseRule(line)
+		if err != nil {
+			return nil, fmt.Errorf(".shield:%d: %v", lineNumber, err)
+		}
+		rule.Env = env
+		rules = append(rules, rule)
+	}
+
+	return rules, scanner.Err()
+}
+
+func parseEnvironment(fields []string, environments map[string]*environment) (*environment, error) {
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("missing environment name")
+	}
+
+	env, ok := environments[fields[0]]
+	if !ok {
+		env = &environment{Name: fields[0]}
+		environments[env.Name] = env
+	}
+
+	for _, option := range fields[1:] {
+		key, value, _ := strings.Cut(option, "=")
+		switch key {
+		case "key":
+			if env.isDefault() {
+				return nil, fmt.Errorf("the default environment uses --passwordFile")
+			}
+			env.KeyFile = expandHome(value)
+		default:
+			return nil, fmt.Errorf("unknown environment option: %q", key)
+		}
+	}
+
+	return env, nil
+}
+
+// parseRule splits the options off the end of a pattern line. Only known
+// options are taken, so a pattern that contains spaces or an = still works.
+func parseRule(line string) (shieldRule, error) {
+	var rule shieldRule
+options:
+	for {
+		i := strings.LastIndexAny(line, " \t")
+		if i < 0 {
+			break
+		}
+		key, value, ok := strings.Cut(line[i+1:], "=")
+		if !ok {
+			break
+		}
+
+		switch key {
+		case "mode":
+			if _, ok := fieldModes[value]; !ok {
+				return rule, fmt.Errorf("unknown mode: %q", value)
+			}
+			rule.Options.Mode = value
+		case "armor":
+			enabled, err := strconv.ParseBool(value)
+			if err != nil {
+				return rule, fmt.Errorf("invalid armor value: %q", value)
+			}
+			rule.Options.Armor = enabled
+		case "deterministic":
+			enabled, err := strconv.ParseBool(value)
+			if err != nil {
+				return rule, fmt.Errorf("invalid deterministic value: %q", value)
+			}
+			rule.Options.Deterministic = enabled
+		case "compress":
+			if _, ok := compressions[value]; !ok {
+				return rule, fmt.Errorf("unknown compression: %q", value)
+			}
+			rule.Options.Compress = value
+		case "cipher":
+			if _, ok := aeads[value]; !ok {
+				return rule, fmt.Errorf("unknown cipher: %q", value)
+			}
+			rule.Options.Cipher = value
+		default:
+			break options
+		}
+		line = strings.TrimSpace(line[:i])
+	}
+
+	if rule.Options.Armor && rule.Options.Mode != "" {
+		return rule, fmt.Errorf("armor cannot be used with mode=%s, whose files are already text", rule.Options.Mode)
+	}
+	if rule.Options.Compress != "" && rule.Options.Mode != "" {
+		return rule, fmt.Errorf("compress cannot be used with mode=%s, whose values are encrypted one by one", rule.Options.Mode)
+	}
+	rule.Pattern = line
+	return rule, nil
+}
+
+func expandHome(path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		return filepath.Join(getHomeDirectory(), path[1:])
+	}
+	return path
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEnvironments(t *testing.T) {
+	defer useCheapKDF()()
+	Encryption = "2.0"
+	SetEncryptionTag()
+
+	tmpDir := t.TempDir()
+	SetDirectory(tmpDir)
+	defer SetEnvironment("")
+
+	shieldConfig := `# shared secrets
+secrets/dev/*
+
+[prod]
+secrets/prod/*
+
+[staging key=` + filepath.Join(tmpDir, "staging-vault") + `]
+secrets/staging/*
+`
+	os.WriteFile(filepath.Join(tmpDir, ".shield"), []byte(shieldConfig), 0644)
+	os.WriteFile(filepath.Join(tmpDir, ".shieldignore"), []byte(""), 0644)
+
+	rules, err := readShieldConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 3 || rules[0].Env.Name != DefaultEnvironment || rules[1].Env.Name != "prod" || rules[2].Env.KeyFile == "" {
+		t.Fatalf("unexpected rules: %+v", rules)
+	}
+
+	for _, env := range []string{"dev", "prod", "staging"} {
+		os.MkdirAll(filepath.Join(tmpDir, "secrets", env), os.ModePerm)
+		os.WriteFile(filepath.Join(tmpDir, "secrets", env, "db.txt"), []byte(env), 0644)
+	}
+
+	keyringDir := filepath.Join(tmpDir, "keys")
+	os.MkdirAll(keyringDir, os.ModePerm)
+	os.WriteFile(filepath.Join(tmpDir, "vault"), []byte("dev-password"), 0600)
+	os.WriteFile(filepath.Join(keyringDir, "prod"), []byte("prod-password"), 0600)
+	SetPasswordFile(filepath.Join(tmpDir, "vault"))
+	SetKeyringDirectory(keyringDir)
+	SetIdentityFiles(nil)
+
+	assertEncrypted := func(step string, expected map[string]bool) {
+		t.Helper()
+		for env, want := range expected {
+			encrypted, err := isFileEncrypted(filepath.Join("secrets", env, "db.txt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if encrypted != want {
+				t.Errorf("%s: secrets/%s/db.txt encrypted = %v, want %v", step, env, encrypted, want)
+			}
+		}
+	}
+
+	// Only prod files are touched with --env prod.
+	SetEnvironment("prod")
+	encryptFiles()
+	assertEncrypted("encrypt prod", map[string]bool{"dev": false, "prod": true, "staging": false})
+
+	// Staging's key is missing, so its files are skipped.
+	SetEnvironment("")
+	encryptFiles()
+	assertEncrypted("encrypt all", map[string]bool{"dev": true, "prod": true, "staging": false})
+
+	// A developer holding only the dev key decrypts dev files and leaves prod
+	// files alone.
+	os.Remove(filepath.Join(keyringDir, "prod"))
+	decryptFiles()
+	assertEncrypted("decrypt with dev key", map[string]bool{"dev": false, "prod": true, "staging": false})
+
+	os.WriteFile(filepath.Join(keyringDir, "prod"), []byte("prod-password"), 0600)
+	decryptFiles()
+	assertEncrypted("decrypt with prod key", map[string]bool{"dev": false, "prod": false, "staging": false})
+}
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		line    string
+		pattern string
+		mode    string
+	}{
+		{"secrets/*", "secrets/*", ""},
+		{"config/*.yaml mode=yaml", "config/*.yaml", "yaml"},
+		{"config/*.json   mode=json", "config/*.json", "json"},
+		{"my secrets/a=b.txt", "my secrets/a=b.txt", ""},
+	}
+	for _, tt := range tests {
+		rule, err := parseRule(tt.line)
+		if err != nil {
+			t.Errorf("parseRule(%q): %v", tt.line, err)
+			continue
+		}
+		if rule.Pattern != tt.pattern || rule.Options.Mode != tt.mode {
+			t.Errorf("parseRule(%q) = %q mode=%q, want %q mode=%q", tt.line, rule.Pattern, rule.Options.Mode, tt.pattern, tt.mode)
+		}
+	}
+
+	if _, err := parseRule("config/*.xml mode=xml"); err == nil {
+		t.Error("expected an error for an unknown mode")
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// CredentialHelperEnv names the credential helper when --credential-helper is
+// not given.
+const CredentialHelperEnv = "SHIELD_CREDENTIAL_HELPER"
+
+// Credential helpers work like git's. Shield runs `shield-credential-<name>
+// get` and writes a request to its stdin, one key=value pair per line, ending
+// with a blank line:
+//
+//	key=vault
+//	directory=/home/alice/project
+//
+// key is "vault" for the vault password and the environment name for an
+// environment's key. The helper answers on stdout in the same form:
+//
+//	password=correct-horse-battery-staple
+//
+// Unknown keys are ignored on both sides, so the protocol can grow. A helper
+// that does not have the key answers without a password and exits cleanly.
+
+// getCredential asks the credential helper for the key with the given name.
+// It returns nil without an error when the helper does not have it.
+func getCredential(key string) ([]byte, error) {
+	path, err := credentialHelperPath(CredentialHelper)
+	if err != nil {
+		return nil, err
+	}
+
+	var request bytes.Buffer
+	for _, field := range [][2]string{{"key", key}, {"directory", directory}} {
+		if strings.ContainsAny(field[1], "\n\x00") {
+			return nil, fmt.Errorf("credential %s contains a newline", field[0])
+		}
+		fmt.Fprintf(&request, "%s=%s\n", field[0], field[1])
+	}
+	request.WriteString("\n")
+
+	cmd := exec.Command(path, "get")
+	cmd.Stdin = &request
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("credential helper %s failed: %v", CredentialHelper, err)
+	}
+
+	response := parseCredential(out)
+	if password, ok := response["password"]; ok && password != "" {
+		return []byte(password), nil
+	}
+	return nil, nil
+}
+
+// credentialHelperPath finds shield-credential-<name> on the PATH. A name
+// that is already a path is used as is.
+func credentialHelperPath(name string) (string, error) {
+	if name == "" {
+		return "", errors.New("no credential helper configured")
+	}
+	if strings.ContainsRune(name, filepath.Separator) || strings.ContainsRune(name, '/') {
+		return name, nil
+	}
+
+	path, err := exec.LookPath("shield-credential-" + name)
+	if err != nil {
+		return "", fmt.Errorf("credential helper shield-credential-%s not found on the PATH", name)
+	}
+	return path, nil
+}
+
+// parseCredential reads key=value lines up to the first blank line.
+func parseCredential(content []byte) map[string]string {
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if line == "" {
+			break
+		}
+		if key, value, ok := strings.Cut(line, "="); ok {
+			values[key] = value
+		}
+	}
+	return values
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestCredentialHelper(t *testing.T) {
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("the go tool is needed to build the test credential helper")
+	}
+
+	tmpDir := t.TempDir()
+	binDir := filepath.Join(tmpDir, "bin")
+	helper := filepath.Join(binDir, "shield-credential-test")
+	if runtime.GOOS == "windows" {
+		helper += ".exe"
+	}
+	if out, err := exec.Command(goTool, "build", "-o", helper, "./cmd/shield-credential-test").CombinedOutput(); err != nil {
+		t.Fatalf("failed to build the test credential helper: %v\n%s", err, out)
+	}
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	credentials := filepath.Join(tmpDir, "credentials")
+	os.WriteFile(credentials, []byte("vault=from helper\nprod=prod key\n"), 0600)
+	t.Setenv("SHIELD_CREDENTIAL_TEST_FILE", credentials)
+
+	SetCredentialHelper("test")
+	defer SetCredentialHelper("")
+	SetKeyringDirectory(filepath.Join(tmpDir, "vault.d"))
+
+	if password, err := getVaultPassword(); err != nil || string(password) != "from helper" {
+		t.Errorf("read vault password %q, %v from the helper, want %q", password, err, "from helper")
+	}
+
+	password, err := (&environment{Name: "prod"}).password()
+	if err != nil || password == nil || string(password.Secret) != "prod key" {
+		t.Errorf("read prod key %v, %v from the helper, want %q", password, err, "prod key")
+	}
+
+	if password, err := (&environment{Name: "staging"}).password(); err != nil || password != nil {
+		t.Errorf("read staging key %v, %v, want no key", password, err)
+	}
+
+	SetCredentialHelper("missing")
+	if _, err := getCredential("vault"); err == nil {
+		t.Error("a missing credential helper did not return an error")
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// Files matched by a pattern with deterministic=true are encrypted SIV-style:
+// the KDF salt is derived from the file's path, and each nonce from the key
+// and the plaintext, so the same plaintext under the same key and path always
+// gives the same ciphertext. Decrypting and re-encrypting an unchanged file
+// then leaves git with nothing to commit.
+//
+// The price is that anyone who can read the repository can tell when two
+// versions of a file, or two values at the same path, are equal. Nonces are
+// still never reused for different plaintexts, so nothing else is revealed.
+
+var errDeterministicRecipients = errors.New("deterministic encryption needs a vault password, files encrypted to recipients use a random key")
+
+// sivSalt derives the KDF salt from the file's path.
+func sivSalt(path string) []byte {
+	sum := sha256.Sum256([]byte("shield deterministic salt\x00" + path))
+	return sum[:16]
+}
+
+// sivNonce derives a nonce of size bytes from the key and everything that is
+// encrypted or authenticated with it.
+func sivNonce(key []byte, size int, data ...[]byte) []byte {
+	mac := hmac.New(sha256.New, fieldSubkey(key, "shield synthetic nonce"))
+	for _, d := range data {
+		// Length prefixes keep the boundaries between parts unambiguous.
+		fmt.Fprintf(mac, "%d:", len(d))
+		mac.Write(d)
+	}
+	return mac.Sum(nil)[:size]
+}
+
+// deterministicVersion is the encryption version deterministic files are
+// written in. Their nonce depends on the whole plaintext, so they are not
+// streamed.
+const deterministicVersion = "2.0"
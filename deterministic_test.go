@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDeterministic(t *testing.T) {
+	defer useCheapKDF()()
+	Encryption = "2.0"
+	SetEncryptionTag()
+	keyring := passwordKeyring("vault-password")
+
+	encrypt := func(content, path, mode string) []byte {
+		t.Helper()
+		file := shieldFile{Path: path, Options: fileOptions{Mode: mode, Deterministic: true}}
+		encrypted, err := encryptFileContent([]byte(content), file, keyring)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decrypted, err := decryptFileContent(encrypted, file, keyring)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(decrypted) != content {
+			t.Fatalf("decrypted to %q, want %q", decrypted, content)
+		}
+		return encrypted
+	}
+
+	for _, mode := range []string{"", "yaml", "dotenv"} {
+		content := "password: hunter2\n"
+		if mode == "dotenv" {
+			content = "PASSWORD=hunter2\n"
+		}
+
+		first := encrypt(content, "secrets/app.env", mode)
+		if !bytes.Equal(first, encrypt(content, "secrets/app.env", mode)) {
+			t.Errorf("mode %q: same plaintext, key and path gave different ciphertext", mode)
+		}
+		if bytes.Equal(first, encrypt(content, "secrets/other.env", mode)) {
+			t.Errorf("mode %q: different paths gave the same ciphertext", mode)
+		}
+		if bytes.Equal(first, encrypt(content+"# changed\n", "secrets/app.env", mode)) {
+			t.Errorf("mode %q: different plaintexts gave the same ciphertext", mode)
+		}
+	}
+
+	// Files encrypted without the option still get fresh randomness.
+	a, _ := encryptFileContent([]byte("secret"), shieldFile{Path: "a"}, keyring)
+	b, _ := encryptFileContent([]byte("secret"), shieldFile{Path: "a"}, keyring)
+	if bytes.Equal(a, b) {
+		t.Error("randomized encryption gave the same ciphertext twice")
+	}
+
+	identity, _ := generateX25519Identity()
+	recipient, _ := parseRecipient("shield-x25519", strings.Fields(identity.PublicKey())[1])
+	recipients := &Keyring{Recipients: []Recipient{recipient}}
+	_, err := encryptFileContent([]byte("secret"), shieldFile{Path: "a", Options: fileOptions{Deterministic: true}}, recipients)
+	if !errors.Is(err, errDeterministicRecipients) {
+		t.Errorf("expected deterministic encryption to recipients to fail, got %v", err)
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Structured files can be encrypted value by value instead of as a whole, so
+// their keys and layout stay readable in code review. Each value is replaced
+// in place by a token:
+//
+//	password: SHIELD[2.0]:dGhlIG5vbmNlIGFuZCBjaXBoZXJ0ZXh0...
+//
+// The token is the encryption tag followed by the base64 of a random nonce
+// and the ciphertext of the value, from the cipher named in the file header.
+// The value's path in the document is authenticated with it, so values cannot
+// be moved around.
+//
+// The file header is stored under the reserved top-level key "shield", or in a
+// "# shield:" comment in .env files, as the tag followed by the base64 of its
+// JSON. Its MAC covers the path and token of every encrypted value, and the
+// file's own path, so removing or swapping values or files is detected too.
+
+// fieldMetadataKey is the top-level key that holds the file header.
+const fieldMetadataKey = "shield"
+
+// fieldTokenPattern matches an encrypted value or file header anywhere in a
+// file, to tell files encrypted value by value from plaintext ones.
+var fieldTokenPattern = regexp.MustCompile(`SHIELD\[[0-9.]+\]:[A-Za-z0-9+/]{16,}={0,2}`)
+
+// fieldValuePattern matches a value that is entirely a token.
+var fieldValuePattern = regexp.MustCompile(`^SHIELD\[[0-9.]+\]:[A-Za-z0-9+/]+={0,2}$`)
+
+// field is a single value in a structured file.
+type field struct {
+	// Path locates the value in the document, like /database/password.
+	Path string
+	// Value is the token when Encrypted is set, and otherwise the plaintext
+	// that is encrypted, in whatever form the document needs to restore it.
+	Value     []byte
+	Encrypted bool
+
+	set func(value []byte, encrypted bool)
+}
+
+func (f *field) update(value []byte, encrypted bool) {
+	f.Value, f.Encrypted = value, encrypted
+	f.set(value, encrypted)
+}
+
+// fieldDocument is a structured file whose values can be encrypted in place.
+type fieldDocument interface {
+	// fields returns the document's values in order, without the header.
+	fields() []*field
+	metadata() (string, bool)
+	setMetadata(value string)
+	removeMetadata()
+	bytes() ([]byte, error)
+}
+
+// Modes for encrypting structured files value by value, set per pattern in
+// .shield with mode=.
+var fieldModes = map[string]func(content []byte) (fieldDocument, error){
+	"dotenv": parseDotenvDocument,
+	"json":   parseJSONDocument,
+	"yaml":   parseYAMLDocument,
+}
+
+func parseFieldDocument(mode string, content []byte) (fieldDocument, error) {
+	parse, ok := fieldModes[mode]
+	if !ok {
+		return nil, fmt.Errorf("unsupported mode: %q", mode)
+	}
+	return parse(content)
+}
+
+// textEdit replaces content[start:end] with text, for documents that are
+// edited in place to keep their formatting.
+type textEdit struct {
+	start, end int
+	text       []byte
+}
+
+// applyEdits applies edits that do not overlap to a copy of content.
+func applyEdits(content []byte, edits []textEdit) []byte {
+	edits = append([]textEdit(nil), edits...)
+	sort.SliceStable(edits, func(i, j int) bool { return edits[i].start > edits[j].start })
+
+	content = append([]byte(nil), content...)
+	for _, edit := range edits {
+		content = append(content[:edit.start], append(append([]byte(nil), edit.text...), content[edit.end:]...)...)
+	}
+	return content
+}
+
+// isFieldToken reports whether value is an encrypted value.
+func isFieldToken(value string) bool {
+	return fieldValuePattern.MatchString(value)
+}
+
+// encryptFields encrypts every plaintext value in a structured file. Values
+// that are already encrypted are kept, so new values can be added to an
+// encrypted file and encrypted with its existing key. A header written before
+// files were bound to their path is bound to opts' path from then on.
+func encryptFields(content []byte, mode string, keyring *Keyring, opts encryptOptions) ([]byte, error) {
+	doc, err := parseFieldDocument(mode, content)
+	if err != nil {
+		return nil, err
+	}
+	fields := doc.fields()
+
+	var header fileHeader
+	var key []byte
+	if encoded, ok := doc.metadata(); ok {
+		if header, key, err = readFieldHeader(encoded, fields, keyring, opts.path); err != nil {
+			return nil, err
+		}
+		if header.Path == "" {
+			header.Path = opts.path
+		}
+	} else {
+		for _, f := range fields {
+			if f.Encrypted {
+				return nil, fmt.Errorf("%s is encrypted but the file has no %q header", f.Path, fieldMetadataKey)
+			}
+		}
+		if _, ok := fieldVersions[Encryption]; !ok {
+			return nil, fmt.Errorf("encryption version %s cannot encrypt individual values", Encryption)
+		}
+		header = fileHeader{Version: Encryption, Cipher: opts.cipherName(), Path: opts.path}
+		if err := checkCipher(header); err != nil {
+			return nil, err
+		}
+		if key, err = newFileKey(&header, keyring, opts); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, f := range fields {
+		if f.Encrypted {
+			continue
+		}
+		token, err := sealField(header, key, f.Path, f.Value, opts.deterministic)
+		if err != nil {
+			return nil, err
+		}
+		f.update([]byte(token), true)
+	}
+
+	header.MAC = fieldMAC(key, header.Path, fields)
+	encoded, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	doc.setMetadata("SHIELD[" + header.Version + "]:" + base64.StdEncoding.EncodeToString(encoded))
+	return doc.bytes()
+}
+
+// decryptFields decrypts every encrypted value in a structured file and
+// removes its header. It fails when the file was encrypted for a path other
+// than path, unless path is empty.
+func decryptFields(content []byte, mode string, keyring *Keyring, path string) ([]byte, error) {
+	doc, err := parseFieldDocument(mode, content)
+	if err != nil {
+		return nil, err
+	}
+	fields := doc.fields()
+
+	encoded, ok := doc.metadata()
+	if !ok {
+		return nil, fmt.Errorf("missing %q header", fieldMetadataKey)
+	}
+	header, key, err := readFieldHeader(encoded, fields, keyring, path)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range fields {
+		if !f.Encrypted {
+			continue
+		}
+		plaintext, err := openField(header, key, f.Path, string(f.Value))
+		if err != nil {
+			return nil, err
+		}
+		f.update(plaintext, false)
+	}
+
+	doc.removeMetadata()
+	return doc.bytes()
+}
+
+// fieldsNeedEncryption reports whether a structured file has any plaintext
+// values left.
+func fieldsNeedEncryption(content []byte, mode string) (bool, error) {
+	doc, err := parseFieldDocument(mode, content)
+	if err != nil {
+		return false, err
+	}
+	for _, f := range doc.fields() {
+		if !f.Encrypted {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// fieldVersions are the encryption versions that can encrypt values. Values
+// are small, so 3.0 seals each in one piece, the same way as 2.0.
+var fieldVersions = map[string]bool{"2.0": true, "3.0": true}
+
+// readFieldHeader decodes the file header, recovers the file key and checks
+// the MAC over the encrypted values.
+func readFieldHeader(encoded string, fields []*field, keyring *Keyring, path string) (fileHeader, []byte, error) {
+	var header fileHeader
+	version, rest, ok := parseEncryptionTag([]byte(encoded))
+	if !ok {
+		return header, nil, fmt.Errorf("invalid %q header", fieldMetadataKey)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(string(rest))
+	if err != nil {
+		return header, nil, fmt.Errorf("invalid %q header: %v", fieldMetadataKey, err)
+	}
+	if err := json.Unmarshal(decoded, &header); err != nil {
+		return header, nil, fmt.Errorf("invalid %q header: %v", fieldMetadataKey, err)
+	}
+	if header.Version != version || !fieldVersions[version] {
+		return header, nil, fmt.Errorf("unsupported encryption version: %q", header.Version)
+	}
+	if err := checkCipher(header); err != nil {
+		return header, nil, err
+	}
+	if err := checkPath(header, path); err != nil {
+		return header, nil, err
+	}
+
+	key, err := fileKey(header, keyring)
+	if err != nil {
+		return header, nil, err
+	}
+
+	if !hmac.Equal(header.MAC, fieldMAC(key, header.Path, fields)) {
+		return header, nil, errors.New("encrypted values were changed or removed since the file was encrypted")
+	}
+	return header, key, nil
+}
+
+// fieldMAC authenticates the path and token of every encrypted value, and the
+// path of the file when it is bound to one. Values are sorted first, so
+// reordering keys does not invalidate the file.
+func fieldMAC(key []byte, filePath string, fields []*field) []byte {
+	var entries []string
+	for _, f := range fields {
+		if f.Encrypted {
+			entries = append(entries, f.Path+"\x00"+string(f.Value)+"\x00")
+		}
+	}
+	sort.Strings(entries)
+
+	mac := hmac.New(sha256.New, fieldSubkey(key, "shield field mac"))
+	if filePath != "" {
+		// Value paths start with a slash, so this cannot collide with them.
+		io.WriteString(mac, "file\x00"+filePath+"\x00")
+	}
+	for _, entry := range entries {
+		io.WriteString(mac, entry)
+	}
+	return mac.Sum(nil)
+}
+
+func sealField(header fileHeader, key []byte, path string, plaintext []byte, deterministic bool) (string, error) {
+	version := header.Version
+	aead, err := newAEAD(header.Cipher, fieldSubkey(key, "shield field values"))
+	if err != nil {
+		return "", err
+	}
+
+	var nonce []byte
+	if deterministic {
+		nonce = sivNonce(key, aead.NonceSize(), fieldAdditionalData(version, path), plaintext)
+	} else {
+		nonce = make([]byte, aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return "", err
+		}
+	}
+
+	sealed := aead.Seal(nonce, nonce, plaintext, fieldAdditionalData(version, path))
+	return "SHIELD[" + version + "]:" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func openField(header fileHeader, key []byte, path string, token string) ([]byte, error) {
+	version := header.Version
+	tokenVersion, rest, ok := parseEncryptionTag([]byte(token))
+	if !ok || tokenVersion != version {
+		return nil, fmt.Errorf("%s: invalid encrypted value", path)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(string(rest))
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid encrypted value", path)
+	}
+
+	aead, err := newAEAD(header.Cipher, fieldSubkey(key, "shield field values"))
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("%s: invalid encrypted value", path)
+	}
+
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], fieldAdditionalData(version, path))
+	if err != nil {
+		return nil, fmt.Errorf("%s: authentication failed, the value is corrupt or was moved", path)
+	}
+	return plaintext, nil
+}
+
+func fieldAdditionalData(version, path string) []byte {
+	return []byte("SHIELD[" + version + "]:" + path)
+}
+
+// fieldSubkey derives a key for one purpose from the file key.
+func fieldSubkey(key []byte, info string) []byte {
+	subkey := make([]byte, 32)
+	io.ReadFull(hkdf.New(sha256.New, key, nil, []byte(info)), subkey)
+	return subkey
+}
+
+// fieldPath appends a segment to a document path, escaped as in a JSON
+// pointer.
+func fieldPath(parent, segment string) string {
+	segment = strings.ReplaceAll(segment, "~", "~0")
+	segment = strings.ReplaceAll(segment, "/", "~1")
+	return parent + "/" + segment
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// dotenvMetadataPrefix starts the comment line that holds the file header in
+// a .env file, so it is not loaded as a variable.
+const dotenvMetadataPrefix = "# " + fieldMetadataKey + ": "
+
+// dotenvDocument encrypts the values of KEY=value lines in a .env file. It
+// edits the file in place by byte offset, so keys, comments, blank lines and
+// quoting are kept exactly. The plaintext of a value is its raw text,
+// including any quotes.
+type dotenvDocument struct {
+	content []byte
+	values  []*field
+	edits   []textEdit
+	newline string
+
+	// meta is the header comment line, newline included, if there is one.
+	meta *dotenvMetadata
+}
+
+type dotenvMetadata struct {
+	start, end           int
+	valueStart, valueEnd int
+	value                string
+}
+
+func parseDotenvDocument(content []byte) (fieldDocument, error) {
+	doc := &dotenvDocument{content: content, newline: "\n"}
+	if bytes.Contains(content, []byte("\r\n")) {
+		doc.newline = "\r\n"
+	}
+
+	lineNumber := 0
+	for pos := 0; pos < len(content); {
+		lineNumber++
+		lineEnd := bytes.IndexByte(content[pos:], '\n')
+		if lineEnd < 0 {
+			lineEnd = len(content)
+		} else {
+			lineEnd += pos
+		}
+		next := lineEnd
+		if next < len(content) {
+			next++
+		}
+
+		line := strings.TrimRight(string(content[pos:lineEnd]), "\r")
+		trimmed := strings.TrimLeft(line, " \t")
+		switch {
+		case strings.HasPrefix(trimmed, dotenvMetadataPrefix):
+			valueStart := pos + len(line) - len(trimmed) + len(dotenvMetadataPrefix)
+			valueEnd := pos + len(line)
+			doc.meta = &dotenvMetadata{
+				start: pos, end: next,
+				valueStart: valueStart, valueEnd: valueEnd,
+				value: string(content[valueStart:valueEnd]),
+			}
+			pos = next
+			continue
+		case trimmed == "" || strings.HasPrefix(trimmed, "#"):
+			pos = next
+			continue
+		}
+
+		offset := pos + len(line) - len(trimmed)
+		assignment := strings.TrimPrefix(trimmed, "export ")
+		offset += len(trimmed) - len(assignment)
+
+		eq := strings.IndexByte(assignment, '=')
+		key := ""
+		if eq >= 0 {
+			key = strings.TrimSpace(assignment[:eq])
+		}
+		if key == "" {
+			return nil, fmt.Errorf("line %d: expected KEY=value", lineNumber)
+		}
+
+		valueStart := offset + eq + 1
+		for valueStart < lineEnd && (content[valueStart] == ' ' || content[valueStart] == '\t') {
+			valueStart++
+		}
+
+		var valueEnd int
+		if valueStart < len(content) && (content[valueStart] == '"' || content[valueStart] == '\'') {
+			// Quoted values can span lines and hold #.
+			end := dotenvClosingQuote(content, valueStart)
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: unterminated quoted value", lineNumber)
+			}
+			valueEnd = end + 1
+			lineNumber += bytes.Count(content[valueStart:valueEnd], []byte("\n"))
+			if i := bytes.IndexByte(content[valueEnd:], '\n'); i >= 0 {
+				next = valueEnd + i + 1
+			} else {
+				next = len(content)
+			}
+		} else {
+			// An unquoted value ends at the line end or an inline comment.
+			valueEnd = pos + len(line)
+			if i := strings.Index(string(content[valueStart:valueEnd]), " #"); i >= 0 {
+				valueEnd = valueStart + i
+			}
+			for valueEnd > valueStart && (content[valueEnd-1] == ' ' || content[valueEnd-1] == '\t') {
+				valueEnd--
+			}
+		}
+
+		// An empty value has nothing worth hiding.
+		if valueEnd > valueStart {
+			doc.addValue(fieldPath("", key), valueStart, valueEnd)
+		}
+		pos = next
+	}
+
+	return doc, nil
+}
+
+// dotenvClosingQuote returns the offset of the quote that closes the one at
+// start, or -1. Backslash escapes are only honoured in double quotes.
+func dotenvClosingQuote(content []byte, start int) int {
+	quote := content[start]
+	for i := start + 1; i < len(content); i++ {
+		switch content[i] {
+		case '\\':
+			if quote == '"' {
+				i++
+			}
+		case quote:
+			return i
+		}
+	}
+	return -1
+}
+
+func (d *dotenvDocument) addValue(path string, start, end int) {
+	value := d.content[start:end]
+	f := &field{Path: path, Value: value, Encrypted: isFieldToken(string(value))}
+	f.set = func(value []byte, encrypted bool) {
+		d.edits = append(d.edits, textEdit{start: start, end: end, text: value})
+	}
+	d.values = append(d.values, f)
+}
+
+func (d *dotenvDocument) fields() []*field {
+	return d.values
+}
+
+func (d *dotenvDocument) metadata() (string, bool) {
+	if d.meta == nil {
+		return "", false
+	}
+	return d.meta.value, true
+}
+
+// setMetadata adds the header comment as the last line. A file without a
+// trailing newline keeps it that way.
+func (d *dotenvDocument) setMetadata(value string) {
+	if d.meta != nil {
+		d.edits = append(d.edits, textEdit{start: d.meta.valueStart, end: d.meta.valueEnd, text: []byte(value)})
+		return
+	}
+
+	line := dotenvMetadataPrefix + value
+	if len(d.content) == 0 {
+		line += d.newline
+	} else if !bytes.HasSuffix(d.content, []byte("\n")) {
+		line = d.newline + line
+	} else {
+		line += d.newline
+	}
+	d.edits = append(d.edits, textEdit{start: len(d.content), end: len(d.content), text: []byte(line)})
+}
+
+func (d *dotenvDocument) removeMetadata() {
+	if d.meta == nil {
+		return
+	}
+	start, end := d.meta.start, d.meta.end
+
+	// A header on a last line without a newline was added after the file's
+	// own last line, so its separating newline goes too.
+	if end == len(d.content) && !bytes.HasSuffix(d.content, []byte("\n")) && start > 0 {
+		start--
+		if start > 0 && d.content[start-1] == '\r' {
+			start--
+		}
+	}
+	d.edits = append(d.edits, textEdit{start: start, end: end})
+}
+
+func (d *dotenvDocument) bytes() ([]byte, error) {
+	return applyEdits(d.content, d.edits), nil
+}
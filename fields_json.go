@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// jsonDocument edits a JSON file in place by byte offset, so its formatting
+// is kept exactly. The plaintext of a value is its raw JSON literal, so
+// numbers and booleans come back with the same type.
+type jsonDocument struct {
+	content []byte
+	values  []*field
+	edits   []textEdit
+
+	// meta is the top-level header member, if there is one.
+	meta *jsonMember
+	// objectStart is the offset of the top-level '{', and lastEnd the end of
+	// the last top-level member, or -1 when the object is empty.
+	objectStart, lastEnd int
+	// indent and separator are copied from the first top-level member for
+	// a header member that is added.
+	indent, separator string
+}
+
+type jsonMember struct {
+	keyStart, valueStart, valueEnd int
+	value                          string
+}
+
+// jsonFrame is an object or array being walked.
+type jsonFrame struct {
+	object    bool
+	path      string
+	key       string
+	index     int
+	expectKey bool
+}
+
+func (f *jsonFrame) childPath() string {
+	if f.object {
+		return fieldPath(f.path, f.key)
+	}
+	return fieldPath(f.path, strconv.Itoa(f.index))
+}
+
+func (f *jsonFrame) advance() {
+	if f.object {
+		f.expectKey = true
+	} else {
+		f.index++
+	}
+}
+
+func parseJSONDocument(content []byte) (fieldDocument, error) {
+	doc := &jsonDocument{content: content, lastEnd: -1, separator: ": "}
+
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+
+	var stack []*jsonFrame
+	var keyStart, keyEnd int
+	done := false
+	for {
+		start := skipJSONSeparators(content, int(decoder.InputOffset()))
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		end := int(decoder.InputOffset())
+
+		if done {
+			return nil, errors.New("unexpected data after the top-level object")
+		}
+		if len(stack) == 0 && token != json.Delim('{') {
+			return nil, errors.New("the top level of the file must be an object")
+		}
+
+		var parent *jsonFrame
+		if len(stack) > 0 {
+			parent = stack[len(stack)-1]
+		}
+
+		switch token := token.(type) {
+		case json.Delim:
+			switch token {
+			case '{', '[':
+				if parent == nil {
+					doc.objectStart = start
+					stack = append(stack, &jsonFrame{object: true, expectKey: true})
+					continue
+				}
+				if len(stack) == 1 && parent.key == fieldMetadataKey {
+					return nil, fmt.Errorf("the top-level %q key is reserved for Shield", fieldMetadataKey)
+				}
+				stack = append(stack, &jsonFrame{object: token == '{', expectKey: token == '{', path: parent.childPath()})
+			case '}', ']':
+				stack = stack[:len(stack)-1]
+				if len(stack) == 0 {
+					done = true
+					continue
+				}
+				if len(stack) == 1 {
+					doc.lastEnd = end
+				}
+				stack[len(stack)-1].advance()
+			}
+
+		case string:
+			if parent.object && parent.expectKey {
+				parent.key = token
+				parent.expectKey = false
+				if len(stack) == 1 {
+					keyStart, keyEnd = start, end
+					if doc.lastEnd < 0 {
+						doc.detectLayout(keyStart, keyEnd)
+					}
+				}
+				continue
+			}
+			if len(stack) == 1 && parent.key == fieldMetadataKey {
+				doc.meta = &jsonMember{keyStart: keyStart, valueStart: start, valueEnd: end, value: token}
+			} else {
+				doc.addValue(parent.childPath(), start, end, isFieldToken(token))
+			}
+			if len(stack) == 1 {
+				doc.lastEnd = end
+			}
+			parent.advance()
+
+		default:
+			if len(stack) == 1 && parent.key == fieldMetadataKey {
+				return nil, fmt.Errorf("the top-level %q key is reserved for Shield", fieldMetadataKey)
+			}
+			// null has nothing worth hiding.
+			if token != nil {
+				doc.addValue(parent.childPath(), start, end, false)
+			}
+			if len(stack) == 1 {
+				doc.lastEnd = end
+			}
+			parent.advance()
+		}
+	}
+
+	if !done {
+		return nil, errors.New("the top level of the file must be an object")
+	}
+	return doc, nil
+}
+
+// skipJSONSeparators skips the whitespace, commas and colons that the
+// decoder consumes before a token.
+func skipJSONSeparators(content []byte, offset int) int {
+	for offset < len(content) {
+		switch content[offset] {
+		case ' ', '\t', '\r', '\n', ',', ':':
+			offset++
+		default:
+			return offset
+		}
+	}
+	return offset
+}
+
+// detectLayout copies the indentation and key separator of the first
+// top-level member.
+func (d *jsonDocument) detectLayout(keyStart, keyEnd int) {
+	lineStart := bytes.LastIndexByte(d.content[:keyStart], '\n')
+	if lineStart < 0 || lineStart < d.objectStart {
+		d.indent, d.separator = "", ":"
+	} else {
+		d.indent = string(d.content[lineStart+1 : keyStart])
+	}
+
+	valueStart := skipJSONSeparators(d.content, keyEnd)
+	if sep := d.content[keyEnd:valueStart]; bytes.Count(sep, []byte(":")) == 1 && !bytes.ContainsAny(sep, "\n,") {
+		d.separator = string(sep)
+	}
+}
+
+func (d *jsonDocument) addValue(path string, start, end int, encrypted bool) {
+	value := d.content[start:end]
+	if encrypted {
+		var token string
+		json.Unmarshal(value, &token)
+		value = []byte(token)
+	}
+
+	f := &field{Path: path, Value: value, Encrypted: encrypted}
+	f.set = func(value []byte, encrypted bool) {
+		text := value
+		if encrypted {
+			text, _ = json.Marshal(string(value))
+		}
+		d.edits = append(d.edits, textEdit{start: start, end: end, text: text})
+	}
+	d.values = append(d.values, f)
+}
+
+func (d *jsonDocument) fields() []*field {
+	return d.values
+}
+
+func (d *jsonDocument) metadata() (string, bool) {
+	if d.meta == nil {
+		return "", false
+	}
+	return d.meta.value, true
+}
+
+func (d *jsonDocument) setMetadata(value string) {
+	encoded, _ := json.Marshal(value)
+	if d.meta != nil {
+		d.edits = append(d.edits, textEdit{start: d.meta.valueStart, end: d.meta.valueEnd, text: encoded})
+		return
+	}
+
+	member := fmt.Sprintf("%q%s%s", fieldMetadataKey, d.separator, encoded)
+	if d.lastEnd < 0 {
+		d.edits = append(d.edits, textEdit{start: d.objectStart + 1, end: d.objectStart + 1, text: []byte(member)})
+		return
+	}
+	if d.indent != "" || d.separator != ":" {
+		member = "\n" + d.indent + member
+	}
+	d.edits = append(d.edits, textEdit{start: d.lastEnd, end: d.lastEnd, text: []byte("," + member)})
+}
+
+// removeMetadata removes the header member along with the comma that
+// separates it from its neighbour.
+func (d *jsonDocument) removeMetadata() {
+	if d.meta == nil {
+		return
+	}
+	start, end := d.meta.keyStart, d.meta.valueEnd
+
+	before := start - 1
+	for before > d.objectStart && isJSONSpace(d.content[before]) {
+		before--
+	}
+	if d.content[before] == ',' {
+		start = before
+	} else {
+		after := end
+		for after < len(d.content) && isJSONSpace(d.content[after]) {
+			after++
+		}
+		if after < len(d.content) && d.content[after] == ',' {
+			end = after + 1
+		}
+	}
+
+	d.edits = append(d.edits, textEdit{start: start, end: end})
+}
+
+func isJSONSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+func (d *jsonDocument) bytes() ([]byte, error) {
+	return applyEdits(d.content, d.edits), nil
+}
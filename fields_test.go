@@ -0,0 +1,230 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestJSONFields(t *testing.T) {
+	defer useCheapKDF()()
+	Encryption = "2.0"
+	SetEncryptionTag()
+	keyring := passwordKeyring("vault-password")
+
+	plaintext := `{
+    "database": {
+        "host": "db.internal",
+        "password": "hunter2",
+        "port": 5432
+    },
+    "replicas": ["a", "b"],
+    "debug": false,
+    "comment": null
+}
+`
+	encrypted, err := encryptFields([]byte(plaintext), "json", keyring, encryptOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"hunter2", "db.internal", "5432"} {
+		if strings.Contains(string(encrypted), secret) {
+			t.Errorf("encrypted file still contains %q:\n%s", secret, encrypted)
+		}
+	}
+	for _, key := range []string{`"password": "SHIELD[2.0]:`, `"comment": null`, `    "shield": "SHIELD[2.0]:`} {
+		if !strings.Contains(string(encrypted), key) {
+			t.Errorf("encrypted file is missing %q:\n%s", key, encrypted)
+		}
+	}
+
+	decrypted, err := decryptFields(encrypted, "json", keyring, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decrypted) != plaintext {
+		t.Errorf("decrypted to\n%s\nwant\n%s", decrypted, plaintext)
+	}
+
+	// A value added to an encrypted file is encrypted with the same key.
+	added := strings.Replace(string(encrypted), `"comment": null`, `"comment": null, "token": "abc123"`, 1)
+	if needed, _ := fieldsNeedEncryption([]byte(added), "json"); !needed {
+		t.Error("expected the added value to need encryption")
+	}
+	reencrypted, err := encryptFields([]byte(added), "json", keyring, encryptOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(reencrypted), "abc123") {
+		t.Error("added value was not encrypted")
+	}
+	if needed, _ := fieldsNeedEncryption(reencrypted, "json"); needed {
+		t.Error("expected every value to be encrypted")
+	}
+	decrypted, err = decryptFields(reencrypted, "json", keyring, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(decrypted), `"token": "abc123"`) {
+		t.Errorf("added value did not decrypt:\n%s", decrypted)
+	}
+
+	if _, err := decryptFields(encrypted, "json", passwordKeyring("wrong"), ""); err == nil {
+		t.Error("expected decryption with the wrong password to fail")
+	}
+}
+
+func TestYAMLFields(t *testing.T) {
+	defer useCheapKDF()()
+	Encryption = "2.0"
+	SetEncryptionTag()
+	keyring := passwordKeyring("vault-password")
+
+	plaintext := `# Database settings
+database:
+  host: db.internal
+  password: hunter2 # rotate yearly
+  port: 5432
+  ssl: "true"
+replicas:
+  - a
+  - b
+empty: null
+`
+	encrypted, err := encryptFields([]byte(plaintext), "yaml", keyring, encryptOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"hunter2", "db.internal", "5432"} {
+		if strings.Contains(string(encrypted), secret) {
+			t.Errorf("encrypted file still contains %q:\n%s", secret, encrypted)
+		}
+	}
+	for _, kept := range []string{"# Database settings", "# rotate yearly", "password: SHIELD[2.0]:", "empty: null", "shield: SHIELD[2.0]:"} {
+		if !strings.Contains(string(encrypted), kept) {
+			t.Errorf("encrypted file is missing %q:\n%s", kept, encrypted)
+		}
+	}
+
+	decrypted, err := decryptFields(encrypted, "yaml", keyring, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decrypted) != plaintext {
+		t.Errorf("decrypted to\n%s\nwant\n%s", decrypted, plaintext)
+	}
+}
+
+func TestDotenvFields(t *testing.T) {
+	defer useCheapKDF()()
+	Encryption = "2.0"
+	SetEncryptionTag()
+	keyring := passwordKeyring("vault-password")
+
+	for _, plaintext := range []string{
+		"# Database\nDB_HOST=db.internal\nexport DB_PASSWORD='hunter2' # rotate yearly\n\nEMPTY=\nCERT=\"line one\nline #two\"\n",
+		"API_KEY=abc123\r\nDEBUG=true",
+		"",
+	} {
+		encrypted, err := encryptFields([]byte(plaintext), "dotenv", keyring, encryptOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, secret := range []string{"db.internal", "hunter2", "line one", "abc123"} {
+			if strings.Contains(string(encrypted), secret) {
+				t.Errorf("encrypted file still contains %q:\n%s", secret, encrypted)
+			}
+		}
+		if !strings.Contains(string(encrypted), "# shield: SHIELD[2.0]:") {
+			t.Errorf("encrypted file has no header:\n%s", encrypted)
+		}
+
+		decrypted, err := decryptFields(encrypted, "dotenv", keyring, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(decrypted) != plaintext {
+			t.Errorf("decrypted to %q, want %q", decrypted, plaintext)
+		}
+	}
+
+	encrypted, _ := encryptFields([]byte("# Database\nexport DB_PASSWORD=hunter2 # rotate yearly\nEMPTY=\n"), "dotenv", keyring, encryptOptions{})
+	lines := strings.Split(string(encrypted), "\n")
+	if lines[0] != "# Database" || !strings.HasPrefix(lines[1], "export DB_PASSWORD=SHIELD[2.0]:") || !strings.HasSuffix(lines[1], " # rotate yearly") || lines[2] != "EMPTY=" {
+		t.Errorf("keys and comments were not kept:\n%s", encrypted)
+	}
+
+	if _, err := parseDotenvDocument([]byte("NOT A VARIABLE\n")); err == nil {
+		t.Error("expected an error for a line without =")
+	}
+}
+
+func TestFieldTampering(t *testing.T) {
+	defer useCheapKDF()()
+	Encryption = "2.0"
+	SetEncryptionTag()
+	keyring := passwordKeyring("vault-password")
+
+	encrypted, err := encryptFields([]byte("a: one\nb: two\n"), "yaml", keyring, encryptOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(string(encrypted), "\n")
+	a, b := strings.TrimPrefix(lines[0], "a: "), strings.TrimPrefix(lines[1], "b: ")
+
+	// Values are bound to their path, so swapping them is detected.
+	swapped := strings.Replace(strings.Replace(string(encrypted), a, "X", 1), b, a, 1)
+	swapped = strings.Replace(swapped, "X", b, 1)
+	if _, err := decryptFields([]byte(swapped), "yaml", keyring, ""); err == nil {
+		t.Error("expected swapped values to fail")
+	}
+
+	// Removing a value breaks the header's MAC.
+	removed := strings.Join(append([]string{}, lines[1:]...), "\n")
+	if _, err := decryptFields([]byte(removed), "yaml", keyring, ""); err == nil {
+		t.Error("expected a removed value to fail")
+	}
+}
+
+func TestFieldMode(t *testing.T) {
+	defer useCheapKDF()()
+	Encryption = "2.0"
+	SetEncryptionTag()
+
+	tmpDir := t.TempDir()
+	SetDirectory(tmpDir)
+	os.WriteFile(filepath.Join(tmpDir, ".shield"), []byte("config.yaml mode=yaml\n"), 0644)
+	os.WriteFile(filepath.Join(tmpDir, ".shieldignore"), []byte(""), 0644)
+	os.WriteFile(filepath.Join(tmpDir, "config.yaml"), []byte("password: hunter2\n"), 0644)
+
+	files := findShieldFiles()
+	if len(files) != 1 || files[0].Options.Mode != "yaml" {
+		t.Fatalf("unexpected files: %+v", files)
+	}
+	keyring := passwordKeyring("vault-password")
+	encryptFile(files[0], keyring)
+
+	if encrypted, _ := files[0].isEncrypted(); !encrypted {
+		t.Error("expected config.yaml to count as encrypted")
+	}
+	if needed, _ := needsEncryption(files[0]); needed {
+		t.Error("expected config.yaml not to need encryption")
+	}
+
+	content, _ := os.ReadFile(filepath.Join(tmpDir, "config.yaml"))
+	os.WriteFile(filepath.Join(tmpDir, "config.yaml"), append(content, "token: abc123\n"...), 0644)
+	if encrypted, _ := files[0].isEncrypted(); !encrypted {
+		t.Error("expected a partially encrypted file to count as encrypted")
+	}
+	if needed, _ := needsEncryption(files[0]); !needed {
+		t.Error("expected the added value to need encryption")
+	}
+
+	encryptFile(files[0], keyring)
+	decryptFile(files[0], keyring)
+	content, _ = os.ReadFile(filepath.Join(tmpDir, "config.yaml"))
+	if string(content) != "password: hunter2\ntoken: abc123\n" {
+		t.Errorf("decrypted to %q", content)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// yamlDocument encrypts the scalars of a YAML file and writes it back out
+// with comments, key order and anchors kept. Layout details such as
+// indentation are normalised by the encoder.
+type yamlDocument struct {
+	root    *yaml.Node
+	mapping *yaml.Node
+	values  []*field
+}
+
+// yamlScalar is the plaintext of an encrypted YAML value. The tag and style
+// are kept so that, for example, a quoted "8080" does not come back as a
+// number.
+type yamlScalar struct {
+	Tag   string     `json:"tag"`
+	Style yaml.Style `json:"style,omitempty"`
+	Value string     `json:"value"`
+}
+
+func parseYAMLDocument(content []byte) (fieldDocument, error) {
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+
+	var root yaml.Node
+	if err := decoder.Decode(&root); err == io.EOF {
+		root = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	} else if err != nil {
+		return nil, err
+	}
+
+	var extra yaml.Node
+	if err := decoder.Decode(&extra); err != io.EOF {
+		return nil, errors.New("files with more than one YAML document are not supported")
+	}
+
+	if len(root.Content) != 1 || root.Content[0].Kind != yaml.MappingNode {
+		return nil, errors.New("the top level of the file must be a mapping")
+	}
+
+	doc := &yamlDocument{root: &root, mapping: root.Content[0]}
+	if err := doc.walk(doc.mapping, "", true); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func (d *yamlDocument) walk(node *yaml.Node, path string, top bool) error {
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if top && key.Value == fieldMetadataKey {
+				if value.Kind != yaml.ScalarNode {
+					return fmt.Errorf("the top-level %q key is reserved for Shield", fieldMetadataKey)
+				}
+				continue
+			}
+			if err := d.walk(value, fieldPath(path, key.Value), false); err != nil {
+				return err
+			}
+		}
+	case yaml.SequenceNode:
+		for i, item := range node.Content {
+			if err := d.walk(item, fieldPath(path, strconv.Itoa(i)), false); err != nil {
+				return err
+			}
+		}
+	case yaml.ScalarNode:
+		// null has nothing worth hiding.
+		if node.Tag != "!!null" {
+			d.addValue(node, path)
+		}
+	}
+	// Aliases point at values that are encrypted where they are defined.
+	return nil
+}
+
+func (d *yamlDocument) addValue(node *yaml.Node, path string) {
+	f := &field{Path: path}
+	if node.Tag == "!!str" && isFieldToken(node.Value) {
+		f.Value, f.Encrypted = []byte(node.Value), true
+	} else {
+		f.Value, _ = json.Marshal(yamlScalar{Tag: node.Tag, Style: node.Style, Value: node.Value})
+	}
+
+	f.set = func(value []byte, encrypted bool) {
+		if encrypted {
+			node.Tag, node.Style, node.Value = "!!str", 0, string(value)
+			return
+		}
+		var scalar yamlScalar
+		if err := json.Unmarshal(value, &scalar); err != nil {
+			scalar = yamlScalar{Tag: "!!str", Value: string(value)}
+		}
+		node.Tag, node.Style, node.Value = scalar.Tag, scalar.Style, scalar.Value
+	}
+	d.values = append(d.values, f)
+}
+
+func (d *yamlDocument) fields() []*field {
+	return d.values
+}
+
+func (d *yamlDocument) metadataIndex() int {
+	for i := 0; i+1 < len(d.mapping.Content); i += 2 {
+		if d.mapping.Content[i].Value == fieldMetadataKey {
+			return i
+		}
+	}
+	return -1
+}
+
+func (d *yamlDocument) metadata() (string, bool) {
+	i := d.metadataIndex()
+	if i < 0 {
+		return "", false
+	}
+	return d.mapping.Content[i+1].Value, true
+}
+
+func (d *yamlDocument) setMetadata(value string) {
+	if i := d.metadataIndex(); i >= 0 {
+		d.mapping.Content[i+1].Value = value
+		return
+	}
+	d.mapping.Content = append(d.mapping.Content,
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: fieldMetadataKey},
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value},
+	)
+}
+
+func (d *yamlDocument) removeMetadata() {
+	if i := d.metadataIndex(); i >= 0 {
+		d.mapping.Content = append(d.mapping.Content[:i], d.mapping.Content[i+2:]...)
+	}
+}
+
+func (d *yamlDocument) bytes() ([]byte, error) {
+	if len(d.mapping.Content) == 0 && d.root.HeadComment == "" && d.root.FootComment == "" {
+		return []byte{}, nil
+	}
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(d.root); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -3,3 +3,11 @@ module github.com/shyce/shield
 go 1.19
 
 require github.com/bmatcuk/doublestar/v4 v4.6.0
+
+require (
+	github.com/klauspost/compress v1.17.4
+	golang.org/x/crypto v0.17.0
+	golang.org/x/sys v0.15.0 // indirect
+	golang.org/x/term v0.15.0
+	gopkg.in/yaml.v3 v3.0.1
+)
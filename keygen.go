@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// vaultKeySize is the number of random bytes in a generated vault key. Keys
+// are base64 encoded so they can be copied and pasted like a password.
+const vaultKeySize = 32
+
+func handleKeygen(args []string) {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	output := fs.String("o", "", "Write the key to this file instead of the vault password file, or the identity file with -identity")
+	identity := fs.Bool("identity", false, "Create a public/private identity pair instead of a vault key")
+	force := fs.Bool("force", false, "Overwrite an existing key file")
+	fs.Usage = func() {
+		fmt.Println("Usage: shield keygen [-identity] [-o <file>] [-force]")
+		fmt.Println("Writes a random vault key, or an identity whose public key can be added with shield grant.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *identity {
+		file := *output
+		if file == "" {
+			file = IdentityFiles[0]
+		}
+		generateIdentityFile(file, *force)
+		return
+	}
+
+	file := *output
+	if file == "" {
+		file = VaultPasswordFile
+	}
+	generateVaultKey(file, *force)
+}
+
+func generateVaultKey(file string, force bool) {
+	key, err := newVaultKey()
+	if err != nil {
+		colorPrint(Red, fmt.Sprintf("Error generating vault key: %s", err))
+		os.Exit(1)
+	}
+
+	if err := writeSecretFile(file, []byte(key+"\n"), force); err != nil {
+		colorPrint(Red, fmt.Sprintf("Error writing vault key: %s", keygenError(err)))
+		os.Exit(1)
+	}
+	colorPrint(Green, fmt.Sprintf("Wrote a new vault key to %s", file))
+	colorPrint(Cyan, "Share it with your team over a secure channel, or use shield grant to give each developer their own key.")
+}
+
+func generateIdentityFile(file string, force bool) {
+	identity, err := generateX25519Identity()
+	if err != nil {
+		colorPrint(Red, fmt.Sprintf("Error generating identity: %s", err))
+		os.Exit(1)
+	}
+
+	content := fmt.Sprintf("# created: %s\n# public key: %s\n%s\n", time.Now().Format(time.RFC3339), identity.PublicKey(), identity)
+	if err := writeSecretFile(file, []byte(content), force); err != nil {
+		colorPrint(Red, fmt.Sprintf("Error writing identity: %s", keygenError(err)))
+		os.Exit(1)
+	}
+	colorPrint(Green, fmt.Sprintf("Wrote a new identity to %s", file))
+	colorPrint(Cyan, "Public key, add it to the repository with shield grant <name> <public key>:")
+	fmt.Println(identity.PublicKey())
+}
+
+func newVaultKey() (string, error) {
+	key := make([]byte, vaultKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(key), nil
+}
+
+func keygenError(err error) string {
+	if os.IsExist(err) {
+		return fmt.Sprintf("%v, use -force to replace it. Files encrypted with the old key can no longer be decrypted, so run shield rekey first", err)
+	}
+	return err.Error()
+}
+
+// writeSecretFile writes content to file, readable only by the current user,
+// creating its directory if needed. An existing file is only replaced when
+// force is set.
+func writeSecretFile(file string, content []byte, force bool) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+
+	f, err := os.OpenFile(file, flags, 0600)
+	if err != nil {
+		return err
+	}
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
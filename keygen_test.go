@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestKeygen(t *testing.T) {
+	tmpDir := t.TempDir()
+	vaultFile := filepath.Join(tmpDir, "ssh", "vault")
+
+	generateVaultKey(vaultFile, false)
+	key, err := readPasswordFile(vaultFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key) != 43 {
+		t.Errorf("generated a %d character vault key, want 43", len(key))
+	}
+
+	if runtime.GOOS != "windows" {
+		info, _ := os.Stat(vaultFile)
+		if perm := info.Mode().Perm(); perm != 0600 {
+			t.Errorf("wrote vault key with mode %o, want 600", perm)
+		}
+	}
+
+	if err := writeSecretFile(vaultFile, []byte("replaced\n"), false); !os.IsExist(err) {
+		t.Errorf("overwriting without force returned %v, want a file exists error", err)
+	}
+
+	os.Chmod(vaultFile, 0644)
+	generateVaultKey(vaultFile, true)
+	replaced, _ := readPasswordFile(vaultFile)
+	if string(replaced) == string(key) {
+		t.Error("forced keygen did not replace the vault key")
+	}
+	if runtime.GOOS != "windows" {
+		info, _ := os.Stat(vaultFile)
+		if perm := info.Mode().Perm(); perm != 0600 {
+			t.Errorf("forced keygen left mode %o, want 600", perm)
+		}
+	}
+
+	identityFile := filepath.Join(tmpDir, "ssh", "shield_identity")
+	generateIdentityFile(identityFile, false)
+
+	identities, err := readIdentityFile(identityFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(identities) != 1 {
+		t.Fatalf("read %d identities, want 1", len(identities))
+	}
+
+	content, _ := os.ReadFile(identityFile)
+	if !strings.Contains(string(content), "# public key: "+identities[0].(*x25519Identity).PublicKey()) {
+		t.Errorf("identity file does not record its public key:\n%s", content)
+	}
+}
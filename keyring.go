@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Keyring holds the keys available to encrypt and decrypt files. Files are
+// encrypted to Recipients when there are any, and with the first of Passwords
+// otherwise. Decryption picks the password whose key the file header checks,
+// or an identity the file key is wrapped for.
+type Keyring struct {
+	Passwords  []*Password
+	Recipients []Recipient
+	Identities []Identity
+
+	// skippedIdentities explains identity files that could not be loaded.
+	// They are only reported when no other identity can decrypt a file.
+	skippedIdentities []string
+}
+
+// Password is a vault password in the keyring.
+type Password struct {
+	Name   string
+	Secret []byte
+
+	// legacySecret is the first line of the password file as openssl read
+	// it, with a \r kept from Windows line endings. SHIELD[1.0] files were
+	// encrypted with it.
+	legacySecret []byte
+}
+
+func newPassword(name string, secret []byte) *Password {
+	return &Password{Name: name, Secret: secret}
+}
+
+// readPasswordEntry reads a password from file, remembering the line as
+// openssl would have read it for SHIELD[1.0] files. The file and password are
+// checked as preflightVaultPassword checks the vault password.
+func readPasswordEntry(name, file string) (*Password, error) {
+	if err := checkPasswordFile(file); err != nil {
+		return nil, err
+	}
+	line, err := readPasswordFileLine(file)
+	if err != nil {
+		return nil, err
+	}
+	password := passwordFromLine(name, line)
+	if err := checkPassword("the key in "+file, password.Secret); err != nil {
+		return nil, err
+	}
+	return password, nil
+}
+
+func passwordFromLine(name string, line []byte) *Password {
+	password := newPassword(name, bytes.TrimSuffix(line, []byte("\r")))
+	password.legacySecret = line
+	return password
+}
+
+// legacy returns the secret SHIELD[1.0] files are encrypted with.
+func (p *Password) legacy() []byte {
+	if p.legacySecret != nil {
+		return p.legacySecret
+	}
+	return p.Secret
+}
+
+// encryptionPassword returns the password new files are encrypted with.
+func (k *Keyring) encryptionPassword() *Password {
+	if len(k.Passwords) == 0 {
+		return nil
+	}
+	return k.Passwords[0]
+}
+
+// readVaultPasswordEntry returns the vault password as a keyring entry. It
+// is not checked again, since preflightVaultPassword has done so.
+func readVaultPasswordEntry() (*Password, error) {
+	if VaultPassword != nil {
+		return newPassword(filepath.Base(VaultPasswordFile), VaultPassword), nil
+	}
+	line, err := readPasswordFileLine(VaultPasswordFile)
+	if err != nil {
+		return nil, err
+	}
+	return passwordFromLine(filepath.Base(VaultPasswordFile), line), nil
+}
+
+// loadKeyring collects the vault password, any extra passwords in the keyring
+// directory, the repository's recipients and the local identities, including
+// those held by shield agent. Any of them may be missing; callers check that
+// the keys they need are present.
+func loadKeyring() (*Keyring, error) {
+	keyring := &Keyring{}
+
+	password, err := readVaultPasswordEntry()
+	if err == nil {
+		keyring.Passwords = append(keyring.Passwords, password)
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error reading vault password file: %v", err)
+	}
+
+	passwords, err := readKeyringDirectory(KeyringDirectory)
+	if err != nil {
+		return nil, fmt.Errorf("error reading keyring: %v", err)
+	}
+	keyring.Passwords = append(keyring.Passwords, passwords...)
+
+	entries, err := readRecipientsFile()
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error reading %s: %v", RecipientsFile, err)
+	}
+	for _, entry := range entries {
+		keyring.Recipients = append(keyring.Recipients, entry.Recipient)
+	}
+
+	for _, file := range IdentityFiles {
+		identities, err := readIdentityFile(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			keyring.skippedIdentities = append(keyring.skippedIdentities, err.Error())
+			continue
+		}
+		keyring.Identities = append(keyring.Identities, identities...)
+	}
+
+	if socket := os.Getenv(AgentSocketEnv); socket != "" {
+		if _, err := callAgent(socket, agentRequest{Op: "list"}); err != nil {
+			keyring.skippedIdentities = append(keyring.skippedIdentities, fmt.Sprintf("shield agent: %v", err))
+		} else {
+			keyring.Identities = append(keyring.Identities, &agentIdentity{socket: socket})
+		}
+	}
+
+	return keyring, nil
+}
+
+// readKeyringDirectory reads every file in dir as a named vault password.
+// A missing directory is an empty keyring.
+func readKeyringDirectory(dir string) ([]*Password, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	var passwords []*Password
+	for _, name := range names {
+		password, err := readPasswordEntry(name, filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		passwords = append(passwords, password)
+	}
+	return passwords, nil
+}
+
+// canEncrypt reports whether the keyring holds a key to encrypt with.
+func (k *Keyring) canEncrypt() bool {
+	return len(k.Recipients) > 0 || len(k.Passwords) > 0
+}
+
+// canDecrypt reports whether the keyring holds any key to decrypt with.
+func (k *Keyring) canDecrypt() bool {
+	return len(k.Identities) > 0 || len(k.Passwords) > 0
+}
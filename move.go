@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v4"
+)
+
+// Files are bound to their path in the repository: the path is recorded in
+// the authenticated header, so someone with write access cannot swap two
+// encrypted files, or move one where it would be read as another, without
+// decryption failing. Files that were renamed on purpose are re-encrypted for
+// their new path with shield mv.
+
+// errMoved is returned when a file is decrypted at a path other than the one
+// it was encrypted for.
+var errMoved = errors.New("file was encrypted for another path")
+
+// checkPath fails when header binds a file to a path other than path. Files
+// encrypted before paths were recorded, and callers that pass no path, are
+// not checked.
+func checkPath(header fileHeader, path string) error {
+	if header.Path == "" || path == "" || header.Path == path {
+		return nil
+	}
+	return fmt.Errorf("%w (%s, found at %s); if it was renamed, run: shield mv %s %s", errMoved, header.Path, path, header.Path, path)
+}
+
+func handleMove(args []string) {
+	if len(args) != 2 {
+		fmt.Println("Usage: shield mv <source> <destination>")
+		fmt.Println("Moves an encrypted file and re-encrypts it for its new path. When the file was")
+		fmt.Println("already moved, for example with git mv, it is re-encrypted where it is.")
+		fmt.Println("Paths are relative to the directory given with -v.")
+		os.Exit(1)
+	}
+
+	oldPath, err := cleanRepoPath(args[0])
+	if err != nil {
+		colorPrint(Red, err.Error())
+		os.Exit(1)
+	}
+	newPath, err := cleanRepoPath(args[1])
+	if err != nil {
+		colorPrint(Red, err.Error())
+		os.Exit(1)
+	}
+
+	from, to, err := moveShieldFiles(oldPath, newPath)
+	if err != nil {
+		colorPrint(Red, err.Error())
+		os.Exit(1)
+	}
+
+	resolveVaultPassword()
+
+	oldFile, newFile := filepath.Join(directory, oldPath), filepath.Join(directory, newPath)
+	_, oldErr := os.Stat(oldFile)
+	_, newErr := os.Stat(newFile)
+	renamed := false
+	switch {
+	case oldErr == nil && os.IsNotExist(newErr):
+		if err := os.MkdirAll(filepath.Dir(newFile), 0755); err != nil {
+			colorPrint(Red, fmt.Sprintf("Error creating directory: %s", err))
+			os.Exit(1)
+		}
+		if err := os.Rename(oldFile, newFile); err != nil {
+			colorPrint(Red, fmt.Sprintf("Error moving file: %s", err))
+			os.Exit(1)
+		}
+		renamed = true
+	case os.IsNotExist(oldErr) && newErr == nil:
+		// Already moved, so only the encryption needs to follow.
+	case oldErr == nil && newErr == nil:
+		colorPrint(Red, fmt.Sprintf("%s already exists", newFile))
+		os.Exit(1)
+	default:
+		colorPrint(Red, fmt.Sprintf("%s does not exist", oldFile))
+		os.Exit(1)
+	}
+
+	rebound, err := moveFile(from, to)
+	if err != nil {
+		if renamed {
+			os.Rename(newFile, oldFile)
+		}
+		colorPrint(Red, fmt.Sprintf("Failed to re-encrypt %s for its new path: %s", newPath, err))
+		os.Exit(1)
+	}
+
+	switch {
+	case !rebound:
+		colorPrint(Green, fmt.Sprintf("Moved %s to %s, it is not encrypted", oldPath, newPath))
+	case renamed:
+		colorPrint(Green, fmt.Sprintf("Moved %s to %s and re-encrypted it for its new path", oldPath, newPath))
+	default:
+		colorPrint(Green, fmt.Sprintf("Re-encrypted %s, moved from %s, for its new path", newPath, oldPath))
+	}
+}
+
+// cleanRepoPath turns a path relative to the shield directory into the form
+// files are matched and bound with.
+func cleanRepoPath(path string) (string, error) {
+	clean := filepath.Clean(path)
+	if filepath.IsAbs(clean) || clean == "." || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is not a path inside %s", path, directory)
+	}
+	return filepath.ToSlash(clean), nil
+}
+
+// moveShieldFiles describes a file before and after a move. The destination
+// must be matched by .shield, since that decides how it is encrypted. The
+// source no longer has to be; it is then assumed to have been encrypted the
+// same way.
+func moveShieldFiles(oldPath, newPath string) (shieldFile, shieldFile, error) {
+	rules, err := readShieldConfig()
+	if err != nil {
+		return shieldFile{}, shieldFile{}, fmt.Errorf("Error reading .shield file: %v", err)
+	}
+	ignorePatterns, err := readPatternsFromFile(".shieldignore")
+	if err != nil {
+		return shieldFile{}, shieldFile{}, fmt.Errorf("Error reading .shieldignore file: %v", err)
+	}
+
+	to, ok := matchShieldFile(newPath, rules, ignorePatterns)
+	if !ok {
+		return shieldFile{}, shieldFile{}, fmt.Errorf("%s is not matched by .shield, so it would not be encrypted", newPath)
+	}
+	from, ok := matchShieldFile(oldPath, rules, ignorePatterns)
+	if !ok {
+		from = shieldFile{Path: oldPath, Env: to.Env, Options: to.Options}
+	}
+	return from, to, nil
+}
+
+// matchShieldFile returns the file at path as findShieldFiles would, with the
+// first rule that matches it.
+func matchShieldFile(path string, rules []shieldRule, ignorePatterns []string) (shieldFile, bool) {
+	for _, omitPattern := range ignorePatterns {
+		if matches, _ := doublestar.Match(omitPattern, path); matches {
+			return shieldFile{}, false
+		}
+	}
+	for _, rule := range rules {
+		if matches, _ := doublestar.Match(rule.Pattern, path); matches {
+			return shieldFile{Path: path, Env: rule.Env, Options: rule.Options}, true
+		}
+	}
+	return shieldFile{}, false
+}
+
+// moveFile re-encrypts the file at to.Path, which was encrypted as from. It
+// reports false without an error for a file that is not encrypted.
+func moveFile(from, to shieldFile) (bool, error) {
+	// The file is still in the format it was encrypted in as from.
+	moved := shieldFile{Path: to.Path, Options: from.Options}
+	encrypted, err := moved.isEncrypted()
+	if err != nil || !encrypted {
+		return false, err
+	}
+
+	if err := preflightVaultPassword(); err != nil {
+		return false, err
+	}
+	keyring, err := loadKeyring()
+	if err != nil {
+		return false, fmt.Errorf("error loading keys: %v", err)
+	}
+	if (from.Env.isDefault() || to.Env.isDefault()) && len(keyring.Identities) == 0 && vaultPasswordMissing() {
+		if err := promptVaultPassword(keyring, false); err != nil {
+			return false, err
+		}
+	}
+
+	// The file is decrypted with every key that might apply, and encrypted
+	// with its new environment's key alone, as encryptFiles would.
+	oldKeyring := &Keyring{Passwords: append([]*Password(nil), keyring.Passwords...), Identities: keyring.Identities, skippedIdentities: keyring.skippedIdentities}
+	newKeyring := keyring
+	for _, env := range []*environment{from.Env, to.Env} {
+		if env.isDefault() {
+			continue
+		}
+		password, err := env.password()
+		if err != nil {
+			return false, fmt.Errorf("error reading key for environment %s: %v", env.Name, err)
+		}
+		if password == nil {
+			continue
+		}
+		oldKeyring.Passwords = append(oldKeyring.Passwords, password)
+		if env == to.Env {
+			newKeyring = &Keyring{Passwords: []*Password{password}}
+		}
+	}
+	if !to.Env.isDefault() && newKeyring == keyring {
+		return false, fmt.Errorf("no key for environment %s", to.Env.Name)
+	}
+	if !newKeyring.canEncrypt() {
+		return false, fmt.Errorf("no vault password found at %s or in %s, and no recipients in %s", VaultPasswordFile, KeyringDirectory, RecipientsFile)
+	}
+
+	rebound, err := reencryptFile(from, to, oldKeyring, newKeyring)
+	if err == nil && !rebound {
+		err = errNoKey
+	}
+	return rebound, err
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPathBinding(t *testing.T) {
+	defer useCheapKDF()()
+	keyring := passwordKeyring("vault-password")
+
+	tests := []struct {
+		version string
+		options fileOptions
+		content string
+	}{
+		{"2.0", fileOptions{}, "secret"},
+		{"3.0", fileOptions{}, "secret"},
+		{"3.0", fileOptions{Compress: "gzip"}, "secret"},
+		{"2.0", fileOptions{Armor: true}, "secret"},
+		{"2.0", fileOptions{Deterministic: true}, "secret"},
+		{"2.0", fileOptions{Mode: "yaml"}, "password: hunter2\n"},
+		{"3.0", fileOptions{Mode: "dotenv"}, "PASSWORD=hunter2\n"},
+	}
+	for _, tt := range tests {
+		Encryption = tt.version
+		SetEncryptionTag()
+
+		file := shieldFile{Path: "secrets/prod.env", Options: tt.options}
+		encrypted, err := encryptFileContent([]byte(tt.content), file, keyring)
+		if err != nil {
+			t.Fatalf("%s %+v: %v", tt.version, tt.options, err)
+		}
+
+		if decrypted, err := decryptFileContent(encrypted, file, keyring); err != nil || string(decrypted) != tt.content {
+			t.Errorf("%s %+v: decrypted to %q, %v", tt.version, tt.options, decrypted, err)
+		}
+
+		moved := shieldFile{Path: "secrets/dev.env", Options: tt.options}
+		if _, err := decryptFileContent(encrypted, moved, keyring); !errors.Is(err, errMoved) {
+			t.Errorf("%s %+v: expected a moved file to fail to decrypt, got %v", tt.version, tt.options, err)
+		}
+	}
+
+	// Files encrypted before paths were recorded still decrypt anywhere.
+	Encryption = "2.0"
+	SetEncryptionTag()
+	unbound, _ := encryptContent([]byte("secret"), keyring)
+	if _, err := decryptFileContent(unbound, shieldFile{Path: "anywhere"}, keyring); err != nil {
+		t.Errorf("expected a file without a path to decrypt, got %v", err)
+	}
+}
+
+func TestMoveFile(t *testing.T) {
+	defer useCheapKDF()()
+	Encryption = "3.0"
+	SetEncryptionTag()
+
+	tmpDir := t.TempDir()
+	SetDirectory(tmpDir)
+	os.MkdirAll(filepath.Join(tmpDir, "secrets"), os.ModePerm)
+	os.WriteFile(filepath.Join(tmpDir, ".shield"), []byte("secrets/*.txt\nconfig/*.yaml mode=yaml\n"), 0644)
+	os.WriteFile(filepath.Join(tmpDir, ".shieldignore"), []byte(""), 0644)
+	keyring := passwordKeyring("vault-password")
+
+	tests := []struct {
+		oldPath, newPath, content string
+	}{
+		{"secrets/old.txt", "secrets/new.txt", "alpha"},
+		{"config/old.yaml", "config/new.yaml", "password: hunter2\n"},
+		// The source no longer matches .shield, and was encrypted as a
+		// whole rather than value by value.
+		{"secrets/app.txt", "config/app.yaml", "password: hunter2\n"},
+	}
+	for _, tt := range tests {
+		os.MkdirAll(filepath.Join(tmpDir, filepath.Dir(tt.oldPath)), os.ModePerm)
+		os.WriteFile(filepath.Join(tmpDir, tt.oldPath), []byte(tt.content), 0644)
+
+		from, to, err := moveShieldFiles(tt.oldPath, tt.newPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encryptFile(from, keyring)
+		if err := os.Rename(filepath.Join(tmpDir, tt.oldPath), filepath.Join(tmpDir, tt.newPath)); err != nil {
+			t.Fatal(err)
+		}
+
+		decryptFile(to, keyring)
+		moved := shieldFile{Path: tt.newPath, Options: from.Options}
+		if encrypted, _ := moved.isEncrypted(); !encrypted {
+			t.Fatalf("%s: expected the moved file to stay encrypted", tt.newPath)
+		}
+
+		rebound, err := reencryptFile(from, to, keyring, keyring)
+		if !rebound || err != nil {
+			t.Fatalf("%s: expected the file to be re-encrypted, got %v", tt.newPath, err)
+		}
+
+		content, _ := os.ReadFile(filepath.Join(tmpDir, tt.newPath))
+		decrypted, err := decryptFileContent(content, to, keyring)
+		if err != nil || string(decrypted) != tt.content {
+			t.Errorf("%s: decrypted to %q, %v", tt.newPath, decrypted, err)
+		}
+	}
+
+	if _, _, err := moveShieldFiles("secrets/a.txt", "public/a.txt"); err == nil {
+		t.Error("expected a destination outside .shield to be refused")
+	}
+	if _, err := cleanRepoPath("../outside.txt"); err == nil {
+		t.Error("expected a path outside the directory to be refused")
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+)
+
+// Environment variables that supply the vault password without a file in
+// ~/.ssh, for CI runners and other machines without a home directory to
+// speak of.
+const (
+	PasswordEnv     = "SHIELD_PASSWORD"
+	PasswordFileEnv = "SHIELD_PASSWORD_FILE"
+)
+
+// readVaultPassword returns the vault password given through the environment,
+// stdin or a password command, and otherwise reads it from VaultPasswordFile.
+func readVaultPassword() ([]byte, error) {
+	if VaultPassword != nil {
+		return VaultPassword, nil
+	}
+	return readPasswordFile(VaultPasswordFile)
+}
+
+// readPasswordFile reads a password from file. Like openssl's file: source,
+// only the first line of the file is used.
+func readPasswordFile(file string) ([]byte, error) {
+	line, err := readPasswordFileLine(file)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(line, []byte("\r")), nil
+}
+
+// readPasswordFileLine reads the first line of file without its \n, keeping a
+// \r before it as openssl's file: source does.
+func readPasswordFileLine(file string) ([]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return readLine(f)
+}
+
+// readPassword reads the first line of r. The line ending is dropped whether
+// it is \n or \r\n, so a password file saved on Windows gives the same key as
+// on Linux or macOS.
+func readPassword(r io.Reader) ([]byte, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(line, []byte("\r")), nil
+}
+
+func readLine(r io.Reader) ([]byte, error) {
+	line, err := bufio.NewReader(r).ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return bytes.TrimSuffix(line, []byte("\n")), nil
+}
+
+// runPasswordCommand runs command through the shell and reads the password
+// from the first line of its output. The command can still prompt the user
+// on the terminal, since only its stdout is captured.
+func runPasswordCommand(command string) ([]byte, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("sh", "-c", command)
+	}
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = os.Stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("password command failed: %v", err)
+	}
+
+	password, err := readPassword(bytes.NewReader(out))
+	if err != nil {
+		return nil, err
+	}
+	if len(password) == 0 {
+		return nil, errors.New("password command printed an empty password")
+	}
+	return password, nil
+}
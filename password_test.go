@@ -0,0 +1,79 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestPasswordSources(t *testing.T) {
+	defer func() {
+		passwordStdin = false
+		passwordCommand = ""
+		passwordFile = ""
+	}()
+
+	tmpDir := t.TempDir()
+	file := filepath.Join(tmpDir, "ci-vault")
+	os.WriteFile(file, []byte("from file\nignored\n"), 0600)
+
+	t.Setenv(PasswordFileEnv, file)
+	if got := getVaultPasswordFile(); got != file {
+		t.Errorf("password file is %s, want %s from %s", got, file, PasswordFileEnv)
+	}
+	passwordFile = "/explicit/vault"
+	if got := getVaultPasswordFile(); got != passwordFile {
+		t.Errorf("password file is %s, want --passwordFile to win over %s", got, PasswordFileEnv)
+	}
+
+	SetPasswordFile(file)
+	SetVaultPassword(nil)
+	if password, err := readVaultPassword(); err != nil || string(password) != "from file" {
+		t.Errorf("read %q, %v from the vault file, want %q", password, err, "from file")
+	}
+
+	t.Setenv(PasswordEnv, "from env")
+	password, err := getVaultPassword()
+	if err != nil || string(password) != "from env" {
+		t.Errorf("read %q, %v from %s, want %q", password, err, PasswordEnv, "from env")
+	}
+	if _, ok := os.LookupEnv(PasswordEnv); ok {
+		t.Errorf("%s was left in the environment", PasswordEnv)
+	}
+
+	SetVaultPassword(password)
+	if password, err := readVaultPassword(); err != nil || string(password) != "from env" {
+		t.Errorf("read %q, %v, want the vault password to override the file", password, err)
+	}
+	SetVaultPassword(nil)
+
+	if runtime.GOOS != "windows" {
+		passwordCommand = "echo from command; echo ignored"
+		if password, err := getVaultPassword(); err != nil || string(password) != "from command" {
+			t.Errorf("read %q, %v from the password command, want %q", password, err, "from command")
+		}
+
+		passwordCommand = "exit 3"
+		if _, err := getVaultPassword(); err == nil {
+			t.Error("a failing password command did not return an error")
+		}
+		passwordCommand = ""
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.WriteString("from stdin\n")
+	w.Close()
+
+	stdin := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = stdin }()
+
+	passwordStdin = true
+	if password, err := getVaultPassword(); err != nil || string(password) != "from stdin" {
+		t.Errorf("read %q, %v from stdin, want %q", password, err, "from stdin")
+	}
+}
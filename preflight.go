@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"runtime"
+)
+
+// minPasswordEntropy is the estimated strength, in bits, below which Shield
+// warns about the vault password. Keys from shield keygen have 256 bits.
+const minPasswordEntropy = 64
+
+// preflightVaultPassword checks the vault password before files are
+// encrypted or decrypted. A password file that anyone on the machine can read,
+// or that holds no password at all, is refused; a group-readable file or a
+// weak password only gets a warning. Other keys are checked the same way as
+// they are read.
+func preflightVaultPassword() error {
+	if VaultPassword == nil {
+		err := checkPasswordFile(VaultPasswordFile)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	password, err := readVaultPassword()
+	if err != nil {
+		return fmt.Errorf("error reading vault password file: %v", err)
+	}
+	return checkPassword("the vault password", password)
+}
+
+// checkPasswordFile refuses a password file that anyone on the machine can
+// read, and warns about one its group can read.
+func checkPasswordFile(file string) error {
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+
+	warning, err := checkPasswordFileMode(file, info.Mode())
+	if err != nil {
+		return err
+	}
+	if warning != "" {
+		colorPrint(Yellow, warning)
+	}
+	return nil
+}
+
+// checkPassword refuses an empty password and warns about a weak one. name
+// describes the password in messages, as in "the vault password".
+func checkPassword(name string, password []byte) error {
+	if len(password) == 0 {
+		return fmt.Errorf("%s is empty, run shield keygen to create one", name)
+	}
+	if bits := passwordEntropy(password); bits < minPasswordEntropy {
+		colorPrint(Yellow, fmt.Sprintf("Weak password: %s has about %d bits of entropy; shield keygen creates a stronger one", name, int(bits)))
+	}
+	return nil
+}
+
+// checkPasswordFileMode refuses a world-readable password file and returns a
+// warning for a group-readable one. Windows has no such permission bits, so
+// nothing is checked there.
+func checkPasswordFileMode(file string, mode os.FileMode) (string, error) {
+	if runtime.GOOS == "windows" {
+		return "", nil
+	}
+
+	perm := mode.Perm()
+	if perm&0007 != 0 {
+		return "", fmt.Errorf("permissions %04o for %s are too open, run chmod 600 %s", perm, file, file)
+	}
+	if perm&0070 != 0 {
+		return fmt.Sprintf("%s is readable by its group (permissions %04o), consider chmod 600 %s", file, perm, file), nil
+	}
+	return "", nil
+}
+
+// passwordEntropy estimates the strength of password in bits. It takes the
+// lower of two estimates: one from the character classes used and one from
+// how often each character repeats, so neither "password1" nor
+// "aaaaaaaaaaaaaaaaaaaa" looks strong.
+func passwordEntropy(password []byte) float64 {
+	var lower, upper, digit, symbol, other bool
+	counts := make(map[byte]int)
+	for _, c := range password {
+		counts[c]++
+		switch {
+		case c >= 'a' && c <= 'z':
+			lower = true
+		case c >= 'A' && c <= 'Z':
+			upper = true
+		case c >= '0' && c <= '9':
+			digit = true
+		case c > ' ' && c < 0x7f:
+			symbol = true
+		default:
+			other = true
+		}
+	}
+
+	pool := 0
+	for _, class := range []struct {
+		used bool
+		size int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 128}} {
+		if class.used {
+			pool += class.size
+		}
+	}
+	if pool == 0 {
+		return 0
+	}
+	classBits := float64(len(password)) * math.Log2(float64(pool))
+
+	var shannon float64
+	for _, count := range counts {
+		p := float64(count) / float64(len(password))
+		shannon -= p * math.Log2(p)
+	}
+	repetitionBits := float64(len(password)) * shannon
+
+	return math.Min(classBits, repetitionBits)
+}
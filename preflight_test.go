@@ -0,0 +1,90 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestPreflight(t *testing.T) {
+	tmpDir := t.TempDir()
+	SetVaultPassword(nil)
+
+	for _, tc := range []struct {
+		content string
+		mode    os.FileMode
+		ok      bool
+	}{
+		{"d8dBq1T8rFhLqEoM9xYh6q0b7VzKkTnPqXx2b3yJkUw\n", 0600, true},
+		{"d8dBq1T8rFhLqEoM9xYh6q0b7VzKkTnPqXx2b3yJkUw\n", 0640, true},
+		{"weak\n", 0600, true},
+		{"", 0600, false},
+		{"\n", 0600, false},
+		{"\r\n", 0600, false},
+	} {
+		file := filepath.Join(tmpDir, "vault")
+		os.Remove(file)
+		os.WriteFile(file, []byte(tc.content), tc.mode)
+		os.Chmod(file, tc.mode)
+		SetPasswordFile(file)
+
+		err := preflightVaultPassword()
+		if tc.ok && err != nil {
+			t.Errorf("preflight refused %q with mode %o: %v", tc.content, tc.mode, err)
+		}
+		if !tc.ok && err == nil {
+			t.Errorf("preflight accepted %q with mode %o", tc.content, tc.mode)
+		}
+	}
+
+	// Every key file is checked as it is read, not only the vault file.
+	keyringDir := filepath.Join(tmpDir, "vault.d")
+	os.MkdirAll(keyringDir, 0700)
+	os.WriteFile(filepath.Join(keyringDir, "prod"), []byte("\n"), 0600)
+	if _, err := readKeyringDirectory(keyringDir); err == nil {
+		t.Error("an empty key in the keyring directory was accepted")
+	}
+	if runtime.GOOS != "windows" {
+		keyFile := filepath.Join(tmpDir, "staging")
+		os.WriteFile(keyFile, []byte("d8dBq1T8rFhLqEoM9xYh6q0b7VzKkTnPqXx2b3yJkUw\n"), 0644)
+		os.Chmod(keyFile, 0644)
+		if _, err := (&environment{Name: "staging", KeyFile: keyFile}).password(); err == nil {
+			t.Error("a world-readable environment key was accepted")
+		}
+	}
+
+	if runtime.GOOS != "windows" {
+		if _, err := checkPasswordFileMode("vault", 0644); err == nil {
+			t.Error("a world-readable vault file was accepted")
+		}
+		if warning, err := checkPasswordFileMode("vault", 0640); err != nil || warning == "" {
+			t.Errorf("a group-readable vault file returned %q, %v, want a warning", warning, err)
+		}
+		if warning, err := checkPasswordFileMode("vault", 0600); err != nil || warning != "" {
+			t.Errorf("a private vault file returned %q, %v", warning, err)
+		}
+	}
+
+	for password, strong := range map[string]bool{
+		"password1":            false,
+		"aaaaaaaaaaaaaaaaaaaa": false,
+		"correct horse":        false,
+		"d8dBq1T8rFhLqEoM9xYh6q0b7VzKkTnPqXx2b3yJkUw": true,
+		"Tr0ub4dor&3-staple-Vault!":                   true,
+	} {
+		if bits := passwordEntropy([]byte(password)); (bits >= minPasswordEntropy) != strong {
+			t.Errorf("estimated %q at %.0f bits", password, bits)
+		}
+	}
+}
+
+func TestPasswordLineEndings(t *testing.T) {
+	for _, content := range []string{"secret", "secret\n", "secret\r\n", "secret\r\nsecond line\r\n"} {
+		password, err := readPassword(strings.NewReader(content))
+		if err != nil || string(password) != "secret" {
+			t.Errorf("read %q, %v from %q, want %q", password, err, content, "secret")
+		}
+	}
+}
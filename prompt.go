@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+var errNoTerminal = errors.New("no terminal to prompt for the vault password on")
+
+// terminal is the controlling terminal, which may not be stdin or stdout:
+// git runs the pre-commit hook with stdin closed.
+type terminal struct {
+	in  *os.File
+	out io.Writer
+}
+
+func openTerminal() (*terminal, error) {
+	if runtime.GOOS == "windows" {
+		if !term.IsTerminal(int(os.Stdin.Fd())) {
+			return nil, errNoTerminal
+		}
+		return &terminal{in: os.Stdin, out: os.Stderr}, nil
+	}
+
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, errNoTerminal
+	}
+	return &terminal{in: tty, out: tty}, nil
+}
+
+func (t *terminal) Close() {
+	if t.in != os.Stdin {
+		t.in.Close()
+	}
+}
+
+// readPassword prompts for a password with echo turned off.
+func (t *terminal) readPassword(prompt string) ([]byte, error) {
+	fmt.Fprint(t.out, prompt)
+	password, err := term.ReadPassword(int(t.in.Fd()))
+	fmt.Fprintln(t.out)
+	return password, err
+}
+
+func (t *terminal) readLine(prompt string) (string, error) {
+	fmt.Fprint(t.out, prompt)
+	line, err := bufio.NewReader(t.in).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// vaultPasswordMissing reports whether there is no vault password to read,
+// from VaultPasswordFile or anywhere else.
+func vaultPasswordMissing() bool {
+	if VaultPassword != nil {
+		return false
+	}
+	_, err := os.Stat(VaultPasswordFile)
+	return os.IsNotExist(err)
+}
+
+// promptVaultPassword asks for the vault password on the terminal and makes
+// it the keyring's encryption password. When confirm is set the password is
+// asked for twice, so a typo cannot lock files away behind an unknown
+// password. The user is then offered to save it to VaultPasswordFile.
+func promptVaultPassword(keyring *Keyring, confirm bool) error {
+	tty, err := openTerminal()
+	if err != nil {
+		return fmt.Errorf("%v, create %s or set %s", err, VaultPasswordFile, PasswordEnv)
+	}
+	defer tty.Close()
+
+	fmt.Fprintf(tty.out, "No vault password found at %s\n", VaultPasswordFile)
+	password, err := tty.readPassword("Vault password: ")
+	if err != nil {
+		return fmt.Errorf("error reading vault password: %v", err)
+	}
+	if err := checkPassword("the vault password", password); err != nil {
+		return err
+	}
+
+	if confirm {
+		again, err := tty.readPassword("Confirm vault password: ")
+		if err != nil {
+			return fmt.Errorf("error reading vault password: %v", err)
+		}
+		if !bytes.Equal(password, again) {
+			return errors.New("the vault passwords do not match")
+		}
+	}
+
+	SetVaultPassword(password)
+	keyring.Passwords = append([]*Password{newPassword(filepath.Base(VaultPasswordFile), password)}, keyring.Passwords...)
+
+	answer, err := tty.readLine(fmt.Sprintf("Save the vault password to %s? [y/N] ", VaultPasswordFile))
+	if err == nil && (strings.EqualFold(answer, "y") || strings.EqualFold(answer, "yes")) {
+		if err := saveVaultPassword(VaultPasswordFile, password); err != nil {
+			colorPrint(Yellow, fmt.Sprintf("Could not save the vault password: %s", err))
+		} else {
+			colorPrint(Green, fmt.Sprintf("Saved the vault password to %s", VaultPasswordFile))
+		}
+	}
+	return nil
+}
+
+// saveVaultPassword writes password to file, readable only by the current
+// user. An existing file is never overwritten.
+func saveVaultPassword(file string, password []byte) error {
+	return writeSecretFile(file, []byte(string(password)+"\n"), false)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestSaveVaultPassword(t *testing.T) {
+	file := filepath.Join(t.TempDir(), ".ssh", "vault")
+
+	SetPasswordFile(file)
+	SetVaultPassword(nil)
+	if !vaultPasswordMissing() {
+		t.Fatal("the vault password is not missing before it is saved")
+	}
+
+	if err := saveVaultPassword(file, []byte("typed")); err != nil {
+		t.Fatal(err)
+	}
+	if vaultPasswordMissing() {
+		t.Error("the vault password is missing after it was saved")
+	}
+
+	password, err := readPasswordFile(file)
+	if err != nil || string(password) != "typed" {
+		t.Errorf("read back %q, %v, want %q", password, err, "typed")
+	}
+
+	if runtime.GOOS != "windows" {
+		info, _ := os.Stat(file)
+		if perm := info.Mode().Perm(); perm != 0600 {
+			t.Errorf("saved vault password with mode %o, want 600", perm)
+		}
+	}
+
+	if err := saveVaultPassword(file, []byte("other")); err == nil {
+		t.Error("saving the vault password overwrote an existing file")
+	}
+}
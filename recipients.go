@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// RecipientsFile lists the public keys files are encrypted to. It sits next
+// to .shield and is committed with the repository.
+const RecipientsFile = ".shieldrecipients"
+
+// errIncorrectIdentity is returned by Identity.Unwrap when a stanza was not
+// wrapped for that identity.
+var errIncorrectIdentity = errors.New("stanza is not for this identity")
+
+// stanza holds the file key wrapped for a single recipient. It is stored in
+// the file header.
+type stanza struct {
+	Type      string `json:"type"`
+	ID        string `json:"id"`
+	Ephemeral []byte `json:"ephemeral,omitempty"`
+	Key       []byte `json:"key"`
+}
+
+// Recipient is a public key that a file key can be wrapped for.
+type Recipient interface {
+	Wrap(fileKey []byte) (stanza, error)
+}
+
+// Identity is a private key that can unwrap file keys wrapped for its
+// recipient.
+type Identity interface {
+	Unwrap(s stanza) ([]byte, error)
+}
+
+// recipientEntry is a single named line of the recipients file.
+type recipientEntry struct {
+	Name      string
+	Key       string
+	Recipient Recipient
+}
+
+// recipientID is a short fingerprint of a public key, recorded in each stanza
+// so the matching identity can be found.
+func recipientID(keyType string, publicKey []byte) string {
+	sum := sha256.Sum256(append([]byte(keyType+":"), publicKey...))
+	return hex.EncodeToString(sum[:8])
+}
+
+type x25519Recipient struct {
+	publicKey []byte
+}
+
+type x25519Identity struct {
+	secretKey []byte
+	publicKey []byte
+}
+
+func newX25519Identity(secretKey []byte) (*x25519Identity, error) {
+	if len(secretKey) != curve25519.ScalarSize {
+		return nil, errors.New("invalid x25519 secret key length")
+	}
+	publicKey, err := curve25519.X25519(secretKey, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	return &x25519Identity{secretKey: secretKey, publicKey: publicKey}, nil
+}
+
+// generateX25519Identity creates a new random identity.
+func generateX25519Identity() (*x25519Identity, error) {
+	secretKey := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(secretKey); err != nil {
+		return nil, err
+	}
+	return newX25519Identity(secretKey)
+}
+
+// String encodes the identity in the form read by readIdentityFile.
+func (i *x25519Identity) String() string {
+	return "shield-x25519-secret " + base64.StdEncoding.EncodeToString(i.secretKey)
+}
+
+// PublicKey encodes the identity's public key in the form read from the
+// recipients file.
+func (i *x25519Identity) PublicKey() string {
+	return "shield-x25519 " + base64.StdEncoding.EncodeToString(i.publicKey)
+}
+
+func (r *x25519Recipient) Wrap(fileKey []byte) (stanza, error) {
+	ephemeralSecret := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(ephemeralSecret); err != nil {
+		return stanza{}, err
+	}
+	ephemeral, err := curve25519.X25519(ephemeralSecret, curve25519.Basepoint)
+	if err != nil {
+		return stanza{}, err
+	}
+
+	shared, err := curve25519.X25519(ephemeralSecret, r.publicKey)
+	if err != nil {
+		return stanza{}, err
+	}
+
+	wrapped, err := sealFileKey(shared, ephemeral, r.publicKey, fileKey)
+	if err != nil {
+		return stanza{}, err
+	}
+
+	return stanza{
+		Type:      "x25519",
+		ID:        recipientID("x25519", r.publicKey),
+		Ephemeral: ephemeral,
+		Key:       wrapped,
+	}, nil
+}
+
+func (i *x25519Identity) Unwrap(s stanza) ([]byte, error) {
+	if s.Type != "x25519" || s.ID != recipientID("x25519", i.publicKey) {
+		return nil, errIncorrectIdentity
+	}
+
+	shared, err := curve25519.X25519(i.secretKey, s.Ephemeral)
+	if err != nil {
+		return nil, err
+	}
+
+	return openFileKey(shared, s.Ephemeral, i.publicKey, s.Key)
+}
+
+// sealFileKey encrypts fileKey with a key derived from a Diffie-Hellman shared
+// secret and both public keys. Each wrapping key is used exactly once, so a
+// zero nonce is safe.
+func sealFileKey(shared, ephemeral, publicKey, fileKey []byte) ([]byte, error) {
+	aead, err := newWrapAEAD(shared, ephemeral, publicKey)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nil, make([]byte, aead.NonceSize()), fileKey, nil), nil
+}
+
+func openFileKey(shared, ephemeral, publicKey, wrapped []byte) ([]byte, error) {
+	aead, err := newWrapAEAD(shared, ephemeral, publicKey)
+	if err != nil {
+		return nil, err
+	}
+	fileKey, err := aead.Open(nil, make([]byte, aead.NonceSize()), wrapped, nil)
+	if err != nil {
+		return nil, errors.New("failed to unwrap file key")
+	}
+	return fileKey, nil
+}
+
+func newWrapAEAD(shared, ephemeral, publicKey []byte) (cipher.AEAD, error) {
+	salt := append(append([]byte{}, ephemeral...), publicKey...)
+	wrapKey := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte("shield file key")), wrapKey); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(wrapKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// parseRecipient parses a public key in "<type> <base64>" form.
+func parseRecipient(keyType, encoded string) (Recipient, error) {
+	switch keyType {
+	case "shield-x25519":
+		publicKey, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(publicKey) != curve25519.PointSize {
+			return nil, errors.New("invalid shield-x25519 public key")
+		}
+		return &x25519Recipient{publicKey: publicKey}, nil
+	case "ssh-ed25519", "ssh-rsa":
+		return parseSSHRecipient(keyType, encoded)
+	default:
+		return nil, fmt.Errorf("unsupported key type: %q", keyType)
+	}
+}
+
+// readRecipientsFile reads the recipients file in the operating directory.
+// Each line holds a name followed by a public key, either a Shield key or an
+// SSH key in authorized_keys form, for example:
+//
+//	alice shield-x25519 <base64>
+//	bob ssh-ed25519 <base64> bob@laptop
+//
+// Blank lines and lines starting with # are ignored.
+func readRecipientsFile() ([]recipientEntry, error) {
+	f, err := os.Open(filepath.Join(directory, RecipientsFile))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []recipientEntry
+	scanner := bufio.NewScanner(f)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		entry, err := parseRecipientLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", RecipientsFile, lineNumber, err)
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, scanner.Err()
+}
+
+// parseRecipientLine parses a "<name> <key type> <key>" line of the
+// recipients file. A key pasted without a name is refused, since revoke
+// finds recipients by name.
+func parseRecipientLine(line string) (recipientEntry, error) {
+	fields := strings.Fields(line)
+	if len(fields) > 0 && isRecipientKeyType(fields[0]) {
+		return recipientEntry{}, fmt.Errorf("the %s key has no name, expected <name> <key type> <key>, for example: alice %s AAAA... alice@laptop", fields[0], fields[0])
+	}
+	if len(fields) < 3 {
+		return recipientEntry{}, errors.New("expected <name> <key type> <key>")
+	}
+
+	recipient, err := parseRecipient(fields[1], fields[2])
+	if err != nil {
+		return recipientEntry{}, err
+	}
+
+	return recipientEntry{
+		Name:      fields[0],
+		Key:       strings.Join(fields[1:], " "),
+		Recipient: recipient,
+	}, nil
+}
+
+// isRecipientKeyType reports whether parseRecipient accepts keyType.
+func isRecipientKeyType(keyType string) bool {
+	switch keyType {
+	case "shield-x25519", "ssh-ed25519", "ssh-rsa":
+		return true
+	}
+	return false
+}
+
+// readIdentityFile reads private keys from file. The file is either an SSH
+// private key, or Shield keys one per line in "<type> <base64>" form.
+func readIdentityFile(file string) ([]Identity, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseIdentities(file, content)
+}
+
+// parseIdentities parses the contents of an identity file. file is only used
+// in error messages.
+func parseIdentities(file string, content []byte) ([]Identity, error) {
+	if bytes.Contains(content, []byte("-----BEGIN")) {
+		identity, err := parseSSHIdentity(content)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		return []Identity{identity}, nil
+	}
+
+	var identities []Identity
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 || fields[0] != "shield-x25519-secret" {
+			return nil, fmt.Errorf("%s:%d: expected shield-x25519-secret <key>", file, lineNumber)
+		}
+
+		secretKey, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid secret key", file, lineNumber)
+		}
+
+		identity, err := newX25519Identity(secretKey)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", file, lineNumber, err)
+		}
+		identities = append(identities, identity)
+	}
+
+	return identities, scanner.Err()
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecipients(t *testing.T) {
+	Encryption = "2.0"
+	SetEncryptionTag()
+
+	tmpDir := t.TempDir()
+	SetDirectory(tmpDir)
+
+	alice, _ := generateX25519Identity()
+	bob, _ := generateX25519Identity()
+	mallory, _ := generateX25519Identity()
+
+	recipients := fmt.Sprintf("# team\nalice %s\nbob %s\n", alice.PublicKey(), bob.PublicKey())
+	if err := os.WriteFile(filepath.Join(tmpDir, RecipientsFile), []byte(recipients), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := readRecipientsFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Name != "alice" || entries[1].Name != "bob" {
+		t.Fatalf("unexpected recipients: %+v", entries)
+	}
+
+	identityFile := filepath.Join(tmpDir, "identity")
+	os.WriteFile(identityFile, []byte(bob.String()+"\n"), 0600)
+	identities, err := readIdentityFile(identityFile)
+	if err != nil || len(identities) != 1 {
+		t.Fatalf("failed to read identity file: %v", err)
+	}
+
+	keyring := &Keyring{}
+	for _, entry := range entries {
+		keyring.Recipients = append(keyring.Recipients, entry.Recipient)
+	}
+
+	plaintext := []byte("shared secret")
+	encrypted, err := encryptContent(plaintext, keyring)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, identities := range map[string][]Identity{"alice": {alice}, "bob": identities} {
+		decrypted, err := decryptContent(encrypted, &Keyring{Identities: identities})
+		if err != nil {
+			t.Errorf("%s failed to decrypt: %v", name, err)
+		} else if !bytes.Equal(decrypted, plaintext) {
+			t.Errorf("%s decrypted %q, want %q", name, decrypted, plaintext)
+		}
+	}
+
+	if _, err := decryptContent(encrypted, &Keyring{Identities: []Identity{mallory}}); err == nil {
+		t.Error("a non-recipient was able to decrypt")
+	}
+	if _, err := decryptContent(encrypted, passwordKeyring("broy")); err == nil {
+		t.Error("a password was able to decrypt a recipient encrypted file")
+	}
+}
+
+func TestRecipientLineWithoutName(t *testing.T) {
+	tmpDir := t.TempDir()
+	SetDirectory(tmpDir)
+
+	line := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIBh9cQZ0d1Z3zX1XqHn5qH0Qm8dOeZ1lFh0R9u8Tzq3r bob@laptop\n"
+	if err := os.WriteFile(filepath.Join(tmpDir, RecipientsFile), []byte(line), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := readRecipientsFile()
+	if err == nil {
+		t.Fatal("expected a key without a name to be refused")
+	}
+	if !strings.Contains(err.Error(), "<name> <key type> <key>") || !strings.Contains(err.Error(), ":1:") {
+		t.Errorf("expected the error to show the line and the expected format, got: %v", err)
+	}
+}
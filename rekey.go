@@ -0,0 +1,279 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+// rekeyResult records what happened to each file during a rekey.
+type rekeyResult struct {
+	mu      sync.Mutex
+	rotated []string
+	skipped []string
+	// locked are encrypted with a key that is not in the old keyring.
+	locked []string
+	failed map[string]error
+}
+
+func (r *rekeyResult) add(path string, rotated bool, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch {
+	case errors.Is(err, errNoKey):
+		r.locked = append(r.locked, path)
+	case err != nil:
+		r.failed[path] = err
+	case rotated:
+		r.rotated = append(r.rotated, path)
+	default:
+		r.skipped = append(r.skipped, path)
+	}
+}
+
+// NewPasswordEnv holds the new vault password for shield rekey, as
+// PasswordEnv holds the current one.
+const NewPasswordEnv = "SHIELD_NEW_PASSWORD"
+
+func handleRekey(args []string) {
+	fs := flag.NewFlagSet("rekey", flag.ExitOnError)
+	oldPasswordFile := fs.String("old", "", "File holding the current vault password (default: the vault password)")
+	newPasswordFile := fs.String("new", "", "File holding the new vault password")
+	newPasswordCommand := fs.String("new-command", "", "Run a command and read the new vault password from its output")
+	newPasswordStdin := fs.Bool("new-stdin", false, "Read the new vault password from the first line of stdin")
+	fs.Usage = func() {
+		fmt.Println("Usage: shield rekey [-old <file>] (-new <file> | -new-command <command> | -new-stdin)")
+		fmt.Println("Re-encrypts every file matched by .shield with a new vault password. The current")
+		fmt.Println("password is read like any vault password unless -old is given, and the new one")
+		fmt.Printf("can also be set with $%s.\n", NewPasswordEnv)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() > 0 || (*newPasswordFile == "" && *newPasswordCommand == "" && !*newPasswordStdin && os.Getenv(NewPasswordEnv) == "") {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	oldPassword, err := readOldPassword(*oldPasswordFile)
+	if err != nil {
+		colorPrint(Red, fmt.Sprintf("Error reading old password: %s", err))
+		os.Exit(1)
+	}
+
+	nextPassword, err := readNewPassword(*newPasswordFile, *newPasswordCommand, *newPasswordStdin)
+	if err != nil {
+		colorPrint(Red, fmt.Sprintf("Error reading new password: %s", err))
+		os.Exit(1)
+	}
+
+	colorPrint(Cyan, "Rotating vault password...")
+	oldKeyring := &Keyring{Passwords: []*Password{oldPassword}}
+	newKeyring := &Keyring{Passwords: []*Password{nextPassword}}
+	result := rekeyFiles(findShieldFiles(), oldKeyring, newKeyring)
+	printRekeySummary(result)
+
+	if len(result.failed) > 0 {
+		os.Exit(1)
+	}
+}
+
+// readOldPassword reads the password files are rekeyed from: the one in file,
+// or otherwise the vault password from wherever it is given.
+func readOldPassword(file string) (*Password, error) {
+	if file != "" {
+		return readPasswordEntry(filepath.Base(file), file)
+	}
+
+	resolveVaultPassword()
+	if err := preflightVaultPassword(); err != nil {
+		return nil, err
+	}
+	return readVaultPasswordEntry()
+}
+
+// readNewPassword reads the password files are rekeyed to from file, a
+// command, stdin or $SHIELD_NEW_PASSWORD, in that order.
+func readNewPassword(file, command string, stdin bool) (*Password, error) {
+	if file != "" {
+		return readPasswordEntry(filepath.Base(file), file)
+	}
+
+	var secret []byte
+	var err error
+	switch {
+	case command != "":
+		secret, err = runPasswordCommand(command)
+	case stdin:
+		if passwordStdin {
+			return nil, errors.New("the old and new passwords cannot both be read from stdin")
+		}
+		secret, err = readPassword(os.Stdin)
+	default:
+		secret = []byte(os.Getenv(NewPasswordEnv))
+		os.Unsetenv(NewPasswordEnv)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := checkPassword("the new vault password", secret); err != nil {
+		return nil, err
+	}
+	return newPassword("new", secret), nil
+}
+
+// rekeyFiles re-encrypts every encrypted file in files from the old keyring
+// to the new one. Plaintext only ever exists in memory; each file is replaced
+// atomically once it has been encrypted with the new keys.
+func rekeyFiles(files []shieldFile, oldKeyring, newKeyring *Keyring) *rekeyResult {
+	result := &rekeyResult{failed: make(map[string]error)}
+
+	var wg sync.WaitGroup
+	semaphore := make(chan struct{}, runtime.NumCPU())
+	processFiles(files, func(file shieldFile) {
+		rotated, err := rekeyFile(file, oldKeyring, newKeyring)
+		result.add(file.Path, rotated, err)
+	}, &wg, semaphore)
+	wg.Wait()
+
+	sort.Strings(result.rotated)
+	sort.Strings(result.skipped)
+	sort.Strings(result.locked)
+	return result
+}
+
+// rekeyFile re-encrypts a single file. It reports false without an error for
+// files that are not encrypted, and an error wrapping errNoKey for files
+// encrypted with a key other than the old one, such as another environment's.
+func rekeyFile(file shieldFile, oldKeyring, newKeyring *Keyring) (bool, error) {
+	return reencryptFile(file, file, oldKeyring, newKeyring)
+}
+
+// reencryptFile decrypts the file at to.Path as from, the path and options it
+// was encrypted with, and encrypts it again as to. They only differ for a file
+// that was moved.
+func reencryptFile(from, to shieldFile, oldKeyring, newKeyring *Keyring) (bool, error) {
+	path := filepath.Join(directory, to.Path)
+	fromPath := filepath.ToSlash(from.Path)
+
+	head, err := readFileHead(path)
+	if err != nil {
+		return false, err
+	}
+	if decrypter, ok := streamedCipher(head); ok {
+		if encrypter, ok := fileStreamer(to, Encryption); ok {
+			err := rekeyFileStream(path, fromPath, decrypter, encrypter, to.encryptOptions(), oldKeyring, newKeyring)
+			return err == nil, err
+		}
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+
+	if _, _, ok := parseEncryptionTag(content); !ok && !isArmored(content) && (from.Options.Mode == "" || !fieldTokenPattern.Match(content)) {
+		return false, nil
+	}
+
+	decrypted, err := decryptFileContentAt(content, from, oldKeyring, fromPath)
+	if errors.Is(err, errNoKey) {
+		return false, err
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to decrypt with the old keys: %v", err)
+	}
+
+	encrypted, err := encryptFileContent(decrypted, to, newKeyring)
+	if err != nil {
+		return false, fmt.Errorf("failed to encrypt with the new keys: %v", err)
+	}
+
+	if err := writeFileAtomic(path, encrypted); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// rekeyFileStream re-encrypts a streamed file one segment at a time, piping
+// what is decrypted with the old keys straight into encryption with the new
+// ones. The file is only replaced once every segment has authenticated. It
+// must have been encrypted for fromPath.
+func rekeyFileStream(path, fromPath string, decrypter, encrypter streamer, opts encryptOptions, oldKeyring, newKeyring *Keyring) error {
+	src, err := openStreamed(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	pr, pw := io.Pipe()
+	decrypted := make(chan error, 1)
+	go func() {
+		err := decrypter.DecryptStream(pw, src, oldKeyring, fromPath)
+		pw.CloseWithError(err)
+		decrypted <- err
+	}()
+
+	err = writeFileAtomicFunc(path, func(w io.Writer) error {
+		if _, err := io.WriteString(w, EncryptionTag); err != nil {
+			return err
+		}
+		return encrypter.EncryptStream(w, pr, newKeyring, opts)
+	})
+	// Stop the decryption if encryption gave up early.
+	pr.Close()
+
+	if decryptErr := <-decrypted; decryptErr != nil && !errors.Is(decryptErr, io.ErrClosedPipe) {
+		if errors.Is(decryptErr, errNoKey) {
+			return decryptErr
+		}
+		return fmt.Errorf("failed to decrypt with the old keys: %v", decryptErr)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to encrypt with the new keys: %v", err)
+	}
+	return nil
+}
+
+func printRekeySummary(result *rekeyResult) {
+	colorPrint(Cyan, "Rekey summary:")
+
+	colorPrint(Green, fmt.Sprintf("Rotated %d file(s)", len(result.rotated)))
+	for _, path := range result.rotated {
+		colorPrint(Green, fmt.Sprintf("  %s", path))
+	}
+
+	if len(result.skipped) > 0 {
+		colorPrint(Yellow, fmt.Sprintf("Skipped %d file(s) that are not encrypted", len(result.skipped)))
+		for _, path := range result.skipped {
+			colorPrint(Yellow, fmt.Sprintf("  %s", path))
+		}
+	}
+
+	if len(result.locked) > 0 {
+		colorPrint(Yellow, fmt.Sprintf("Skipped %d file(s) encrypted with another key", len(result.locked)))
+		for _, path := range result.locked {
+			colorPrint(Yellow, fmt.Sprintf("  %s", path))
+		}
+	}
+
+	if len(result.failed) > 0 {
+		failed := make([]string, 0, len(result.failed))
+		for path := range result.failed {
+			failed = append(failed, path)
+		}
+		sort.Strings(failed)
+
+		colorPrint(Red, fmt.Sprintf("Failed to rotate %d file(s), they were left unchanged", len(failed)))
+		for _, path := range failed {
+			colorPrint(Red, fmt.Sprintf("  %s: %s", path, result.failed[path]))
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestRekey(t *testing.T) {
+	defer useCheapKDF()()
+	Encryption = "2.0"
+	SetEncryptionTag()
+
+	tmpDir := t.TempDir()
+	SetDirectory(tmpDir)
+
+	files := map[string]string{
+		"secrets/a.txt": "alpha",
+		"secrets/b.txt": "bravo",
+		"secrets/c.txt": "charlie",
+		"public.txt":    "public",
+	}
+	for path, content := range files {
+		fullPath := filepath.Join(tmpDir, path)
+		os.MkdirAll(filepath.Dir(fullPath), os.ModePerm)
+		if err := os.WriteFile(fullPath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.WriteFile(filepath.Join(tmpDir, ".shield"), []byte("secrets/*.txt"), 0644)
+	os.WriteFile(filepath.Join(tmpDir, ".shieldignore"), []byte(""), 0644)
+
+	oldKeyring, newKeyring := passwordKeyring("old"), passwordKeyring("new")
+	encryptFile(shieldFile{Path: "secrets/a.txt"}, oldKeyring)
+	encryptFile(shieldFile{Path: "secrets/b.txt"}, oldKeyring)
+	// secrets/c.txt stays plaintext and should be skipped.
+
+	result := rekeyFiles(findShieldFiles(), oldKeyring, newKeyring)
+
+	if len(result.failed) != 0 {
+		t.Errorf("unexpected failures: %v", result.failed)
+	}
+	if len(result.rotated) != 2 || result.rotated[0] != "secrets/a.txt" || result.rotated[1] != "secrets/b.txt" {
+		t.Errorf("rotated %v, want [secrets/a.txt secrets/b.txt]", result.rotated)
+	}
+	if len(result.skipped) != 1 || result.skipped[0] != "secrets/c.txt" {
+		t.Errorf("skipped %v, want [secrets/c.txt]", result.skipped)
+	}
+
+	for _, path := range []string{"secrets/a.txt", "secrets/b.txt"} {
+		content, _ := os.ReadFile(filepath.Join(tmpDir, path))
+		if _, err := decryptContent(content, oldKeyring); err == nil {
+			t.Errorf("%s still decrypts with the old password", path)
+		}
+		decrypted, err := decryptContent(content, newKeyring)
+		if err != nil {
+			t.Errorf("%s does not decrypt with the new password: %v", path, err)
+		} else if string(decrypted) != files[path] {
+			t.Errorf("%s decrypted to %q, want %q", path, decrypted, files[path])
+		}
+	}
+
+	// Files encrypted with a key other than the old one are left untouched.
+	before, _ := os.ReadFile(filepath.Join(tmpDir, "secrets/a.txt"))
+	result = rekeyFiles(findShieldFiles(), oldKeyring, newKeyring)
+	if len(result.rotated) != 0 || len(result.failed) != 0 || len(result.skipped) != 1 || len(result.locked) != 2 {
+		t.Errorf("expected all files to be skipped with the wrong old password, got %+v", result)
+	}
+	after, _ := os.ReadFile(filepath.Join(tmpDir, "secrets/a.txt"))
+	if string(before) != string(after) {
+		t.Error("failed rekey modified the file")
+	}
+}
+
+func TestRekeyPasswordSources(t *testing.T) {
+	defer SetVaultPassword(nil)
+
+	// Without -old, the current vault password is used from wherever it
+	// was given.
+	SetVaultPassword([]byte("d8dBq1T8rFhLqEoM9xYh6q0b7VzKkTnPqXx2b3yJkUw"))
+	if password, err := readOldPassword(""); err != nil || string(password.Secret) != "d8dBq1T8rFhLqEoM9xYh6q0b7VzKkTnPqXx2b3yJkUw" {
+		t.Errorf("read %v, %v as the old password, want the vault password", password, err)
+	}
+
+	t.Setenv(NewPasswordEnv, "new from env")
+	if password, err := readNewPassword("", "", false); err != nil || string(password.Secret) != "new from env" {
+		t.Errorf("read %v, %v as the new password, want it from %s", password, err, NewPasswordEnv)
+	}
+	if _, ok := os.LookupEnv(NewPasswordEnv); ok {
+		t.Errorf("%s was left in the environment", NewPasswordEnv)
+	}
+	if _, err := readNewPassword("", "", false); err == nil {
+		t.Error("an empty new password was accepted")
+	}
+
+	if runtime.GOOS != "windows" {
+		if password, err := readNewPassword("", "echo new from command", false); err != nil || string(password.Secret) != "new from command" {
+			t.Errorf("read %v, %v as the new password, want it from the command", password, err)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Vault keys are split with Shamir's secret sharing over GF(2^8): every byte
+// of the key is the constant term of its own random polynomial of degree k-1,
+// and share x holds each polynomial evaluated at x. Any k shares rebuild the
+// key, and fewer reveal nothing about it.
+//
+// Shares are single lines of text so they can be printed or written down:
+//
+//	shield-share:1:3:2:9f1c2a7b:<base64url data>:5e0d13aa
+//
+// The fields are the format version, the threshold, the share number, an ID
+// shared by every share from the same split, the share data and a checksum of
+// everything before it.
+
+const sharePrefix = "shield-share"
+
+type keyShare struct {
+	Threshold int
+	X         byte
+	SetID     string
+	Data      []byte
+}
+
+func handleKey(args []string) {
+	if len(args) == 0 {
+		fmt.Println("Usage: shield key <split | combine> [OPTION]...")
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "split":
+		handleKeySplit(args[1:])
+	case "combine":
+		handleKeyCombine(args[1:])
+	default:
+		colorPrint(Red, fmt.Sprintf("Unknown key command: %s", args[0]))
+		os.Exit(1)
+	}
+}
+
+func handleKeySplit(args []string) {
+	fs := flag.NewFlagSet("key split", flag.ExitOnError)
+	n := fs.Int("n", 5, "Number of shares to create")
+	k := fs.Int("k", 3, "Number of shares needed to rebuild the key")
+	input := fs.String("in", "", "Split the key in this file instead of the vault password")
+	fs.Usage = func() {
+		fmt.Println("Usage: shield key split [-n <shares>] [-k <threshold>] [-in <file>]")
+		fmt.Println("Splits the vault key into shares, any k of which rebuild it with shield key combine.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	var secret []byte
+	var err error
+	if *input != "" {
+		secret, err = readPasswordFile(*input)
+	} else {
+		resolveVaultPassword()
+		secret, err = readVaultPassword()
+	}
+	if err != nil {
+		colorPrint(Red, fmt.Sprintf("Error reading key: %s", err))
+		os.Exit(1)
+	}
+
+	shares, err := splitKey(secret, *n, *k)
+	if err != nil {
+		colorPrint(Red, fmt.Sprintf("Error splitting key: %s", err))
+		os.Exit(1)
+	}
+
+	for _, share := range shares {
+		fmt.Println(share.String())
+	}
+}
+
+func handleKeyCombine(args []string) {
+	fs := flag.NewFlagSet("key combine", flag.ExitOnError)
+	output := fs.String("o", "", "Write the key to this file instead of the vault password file")
+	force := fs.Bool("force", false, "Overwrite an existing key file")
+	fs.Usage = func() {
+		fmt.Println("Usage: shield key combine [-o <file>] [-force] [share file]...")
+		fmt.Println("Rebuilds a key from shares read from the given files, or from stdin, one per line.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	var shares []keyShare
+	var err error
+	if fs.NArg() == 0 {
+		shares, err = readShares(os.Stdin)
+	} else {
+		for _, file := range fs.Args() {
+			var f *os.File
+			if f, err = os.Open(file); err != nil {
+				break
+			}
+			var fileShares []keyShare
+			fileShares, err = readShares(f)
+			f.Close()
+			if err != nil {
+				err = fmt.Errorf("%s: %v", file, err)
+				break
+			}
+			shares = append(shares, fileShares...)
+		}
+	}
+	if err != nil {
+		colorPrint(Red, fmt.Sprintf("Error reading shares: %s", err))
+		os.Exit(1)
+	}
+
+	secret, err := combineKey(shares)
+	if err != nil {
+		colorPrint(Red, fmt.Sprintf("Error combining shares: %s", err))
+		os.Exit(1)
+	}
+
+	file := *output
+	if file == "" {
+		file = VaultPasswordFile
+	}
+	if err := writeSecretFile(file, []byte(string(secret)+"\n"), *force); err != nil {
+		colorPrint(Red, fmt.Sprintf("Error writing key: %s", keygenError(err)))
+		os.Exit(1)
+	}
+	colorPrint(Green, fmt.Sprintf("Rebuilt the key from %d shares and wrote it to %s", len(shares), file))
+}
+
+// splitKey splits secret into n shares, any k of which rebuild it.
+func splitKey(secret []byte, n, k int) ([]keyShare, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("the key is empty")
+	}
+	if k < 2 || k > n || n > 255 {
+		return nil, errors.New("need 2 <= k <= n <= 255")
+	}
+
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	shares := make([]keyShare, n)
+	for i := range shares {
+		shares[i] = keyShare{Threshold: k, X: byte(i + 1), SetID: hex.EncodeToString(id), Data: make([]byte, len(secret))}
+	}
+
+	coefficients := make([]byte, k)
+	for b, s := range secret {
+		if _, err := rand.Read(coefficients[1:]); err != nil {
+			return nil, err
+		}
+		coefficients[0] = s
+
+		for i := range shares {
+			// Horner's method, from the highest coefficient down.
+			var y byte
+			for j := k - 1; j >= 0; j-- {
+				y = gfMul(y, shares[i].X) ^ coefficients[j]
+			}
+			shares[i].Data[b] = y
+		}
+	}
+	return shares, nil
+}
+
+// combineKey rebuilds the secret from at least a threshold of shares by
+// Lagrange interpolation at x = 0.
+func combineKey(shares []keyShare) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, errors.New("no shares given")
+	}
+
+	first := shares[0]
+	seen := make(map[byte]bool)
+	var unique []keyShare
+	for _, share := range shares {
+		if share.SetID != first.SetID || share.Threshold != first.Threshold || len(share.Data) != len(first.Data) {
+			return nil, errors.New("the shares come from different splits")
+		}
+		if !seen[share.X] {
+			seen[share.X] = true
+			unique = append(unique, share)
+		}
+	}
+	if len(unique) < first.Threshold {
+		return nil, fmt.Errorf("need %d different shares, got %d", first.Threshold, len(unique))
+	}
+	unique = unique[:first.Threshold]
+
+	secret := make([]byte, len(first.Data))
+	for i, share := range unique {
+		// The Lagrange basis polynomial for this share, evaluated at 0.
+		basis := byte(1)
+		for j, other := range unique {
+			if i != j {
+				basis = gfMul(basis, gfDiv(other.X, other.X^share.X))
+			}
+		}
+		for b := range secret {
+			secret[b] ^= gfMul(basis, share.Data[b])
+		}
+	}
+	return secret, nil
+}
+
+func (s keyShare) String() string {
+	body := fmt.Sprintf("%s:1:%d:%d:%s:%s", sharePrefix, s.Threshold, s.X, s.SetID, base64.RawURLEncoding.EncodeToString(s.Data))
+	return body + ":" + shareChecksum(body)
+}
+
+func shareChecksum(body string) string {
+	sum := sha256.Sum256([]byte(body))
+	return hex.EncodeToString(sum[:4])
+}
+
+// parseShare parses a share line, checking its checksum so that a share
+// copied by hand with a typo is caught before it is used.
+func parseShare(line string) (keyShare, error) {
+	i := strings.LastIndexByte(line, ':')
+	if i < 0 {
+		return keyShare{}, errors.New("not a shield share")
+	}
+	body, checksum := line[:i], line[i+1:]
+
+	fields := strings.Split(body, ":")
+	if len(fields) != 6 || fields[0] != sharePrefix {
+		return keyShare{}, errors.New("not a shield share")
+	}
+	if fields[1] != "1" {
+		return keyShare{}, fmt.Errorf("unsupported share version: %s", fields[1])
+	}
+	if shareChecksum(body) != strings.ToLower(checksum) {
+		return keyShare{}, errors.New("checksum mismatch, the share was copied incorrectly")
+	}
+
+	threshold, err := strconv.Atoi(fields[2])
+	if err != nil || threshold < 2 || threshold > 255 {
+		return keyShare{}, errors.New("invalid share threshold")
+	}
+	x, err := strconv.Atoi(fields[3])
+	if err != nil || x < 1 || x > 255 {
+		return keyShare{}, errors.New("invalid share number")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(fields[5])
+	if err != nil || len(data) == 0 {
+		return keyShare{}, errors.New("invalid share data")
+	}
+
+	return keyShare{Threshold: threshold, X: byte(x), SetID: fields[4], Data: data}, nil
+}
+
+// readShares reads one share per line, skipping blank lines and comments.
+func readShares(r io.Reader) ([]keyShare, error) {
+	var shares []keyShare
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		share, err := parseShare(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNumber, err)
+		}
+		shares = append(shares, share)
+	}
+	return shares, scanner.Err()
+}
+
+// GF(2^8) arithmetic with the AES polynomial x^8 + x^4 + x^3 + x + 1, using
+// log and exp tables for the generator 3.
+var gfExp, gfLog = gfTables()
+
+func gfTables() (exp [510]byte, log [256]byte) {
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		exp[i] = x
+		exp[i+255] = x
+		log[x] = byte(i)
+		// Multiply by the generator 3: x*2 ^ x.
+		double := x << 1
+		if x&0x80 != 0 {
+			double ^= 0x1b
+		}
+		x ^= double
+	}
+	return exp, log
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfDiv(a, b byte) byte {
+	if b == 0 {
+		panic("division by zero in GF(256)")
+	}
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+255-int(gfLog[b])]
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestShamir(t *testing.T) {
+	secret := []byte("d8dBq1T8rFhLqEoM9xYh6q0b7VzKkTnPqXx2b3yJkUw")
+
+	shares, err := splitKey(secret, 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lines []string
+	for _, share := range shares {
+		lines = append(lines, share.String())
+	}
+	parsed, err := readShares(strings.NewReader("# offline backup\n" + strings.Join(lines, "\n") + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for a := 0; a < 5; a++ {
+		for b := a + 1; b < 5; b++ {
+			for c := b + 1; c < 5; c++ {
+				combined, err := combineKey([]keyShare{parsed[c], parsed[a], parsed[b]})
+				if err != nil {
+					t.Fatal(err)
+				} else if !bytes.Equal(combined, secret) {
+					t.Errorf("shares %d, %d and %d combined to %q", a+1, b+1, c+1, combined)
+				}
+			}
+		}
+	}
+
+	if _, err := combineKey(parsed[:2]); err == nil {
+		t.Error("combined the key from fewer shares than the threshold")
+	}
+	if _, err := combineKey([]keyShare{parsed[0], parsed[0], parsed[1]}); err == nil {
+		t.Error("combined the key from a repeated share")
+	}
+
+	others, _ := splitKey(secret, 5, 3)
+	if _, err := combineKey([]keyShare{parsed[0], parsed[1], others[2]}); err == nil {
+		t.Error("combined shares from different splits")
+	}
+
+	typo := []byte(lines[0])
+	typo[30] ^= 1
+	if _, err := parseShare(string(typo)); err == nil {
+		t.Error("parsed a share with a bad checksum")
+	}
+
+	for _, bad := range [][2]int{{5, 1}, {2, 3}, {256, 3}} {
+		if _, err := splitKey(secret, bad[0], bad[1]); err == nil {
+			t.Errorf("split into %d shares with threshold %d", bad[0], bad[1])
+		}
+	}
+}
+
+func TestGF256(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			if got := gfDiv(gfMul(byte(a), byte(b)), byte(b)); got != byte(a) {
+				t.Fatalf("%d * %d / %d = %d", a, b, b, got)
+			}
+		}
+	}
+	// From FIPS 197, section 4.2.
+	if got := gfMul(0x57, 0x83); got != 0xc1 {
+		t.Errorf("0x57 * 0x83 = %#x, want 0xc1", got)
+	}
+}
@@ -3,8 +3,10 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
@@ -34,15 +36,24 @@ func colorPrint(color string, text string) {
 }
 
 var (
-	Author             string
-	Encryption         string
-	EncryptionTag      string
-	EncryptionTagBytes int
-	Name               string
-	Version            string
-	VaultPasswordFile  string
+	Author            string
+	Encryption        string
+	EncryptionTag     string
+	Name              string
+	Version           string
+	VaultPasswordFile string
+	VaultPassword     []byte
+	CredentialHelper  string
+	KeyringDirectory  string
+	Environment       string
+	IdentityFiles     []string
+	CipherName        string
 )
 
+// CurrentEncryption is the encryption version used when the build does not
+// set one with -ldflags "-X main.Encryption=...".
+const CurrentEncryption = "3.0"
+
 const (
 	ShieldLinuxPath   = "/usr/local/bin/shield"
 	ShieldWindowsPath = `C:\Windows\System32\shield.exe`
@@ -50,8 +61,8 @@ const (
 )
 
 var (
-	directory, passwordFile                          			 string
-	encrypt, decrypt, generateHook, scan, version, install bool
+	directory, passwordFile, passwordCommand, credentialHelper, keyringDirectory, identityFile, environmentName, cipherName string
+	encrypt, decrypt, generateHook, scan, version, install, passwordStdin                                                   bool
 )
 
 const ShieldNotFound = "Shield is not globally callable for pre-commit hooks. Please ensure Shield is properly installed and added to your system's PATH, then try again. Refer to the Shield README, Downloading and Installing Shield."
@@ -118,7 +129,7 @@ func addFileToGit(file string) {
 }
 
 func scanGitDiff() {
-	shieldPatterns, err := readPatternsFromFile(".shield")
+	shieldRules, err := readShieldConfig()
 	if err != nil {
 		colorPrint(Red, fmt.Sprintf("Error reading .shield file: %s", err))
 		os.Exit(1)
@@ -151,16 +162,16 @@ func scanGitDiff() {
 				continue
 			}
 
-			for _, glob := range shieldPatterns {
-				matched, _ := doublestar.Match(glob, file)
+			for _, rule := range shieldRules {
+				matched, _ := doublestar.Match(rule.Pattern, file)
 				if matched {
-					encrypted, err := isFileEncrypted(file)
+					needed, err := needsEncryption(shieldFile{Path: file, Env: rule.Env, Options: rule.Options})
 					if err != nil {
 						colorPrint(Red, fmt.Sprintf("Error checking encryption status of file: %s", err))
 						os.Exit(1)
 					}
 
-					if !encrypted {
+					if needed {
 						filesToEncrypt = append(filesToEncrypt, file)
 					}
 					break
@@ -191,11 +202,27 @@ func init() {
 	flag.BoolVar(&scan, "scan", false, "Scan git-diff files for unencrypted files")
 	flag.BoolVar(&version, "version", false, "Print version information")
 	flag.BoolVar(&install, "install", false, "Install Shield. Copies current binary to local user PATH")
-	flag.StringVar(&passwordFile, "passwordFile", "", "Specify the password location (default: ~/.ssh/vault)")
+	flag.StringVar(&passwordFile, "passwordFile", "", "Specify the password location (default: $SHIELD_PASSWORD_FILE or ~/.ssh/vault)")
+	flag.BoolVar(&passwordStdin, "password-stdin", false, "Read the vault password from the first line of stdin")
+	flag.StringVar(&passwordCommand, "password-command", "", "Run a command and read the vault password from its output")
+	flag.StringVar(&credentialHelper, "credential-helper", "", "Fetch keys from the shield-credential-<name> helper (default: $SHIELD_CREDENTIAL_HELPER)")
+	flag.StringVar(&environmentName, "env", "", "Only operate on files in this environment from .shield")
+	flag.StringVar(&keyringDirectory, "keyring", "", "Specify a directory of additional vault passwords, one per file (default: ~/.ssh/vault.d)")
+	flag.StringVar(&cipherName, "cipher", "", "Cipher for files whose pattern in .shield does not set one, aes-256-gcm or xchacha20-poly1305 (default: $SHIELD_CIPHER or aes-256-gcm)")
+	flag.StringVar(&identityFile, "identity", "", "Specify the private key location for recipient encrypted files (default: ~/.ssh/shield_identity, ~/.ssh/id_ed25519 and ~/.ssh/id_rsa)")
 	flag.Usage = func() {
-		fmt.Println("Usage: shield [OPTION]...")
+		fmt.Println("Usage: shield [OPTION]... [COMMAND]")
 		fmt.Println("Available options:")
 		flag.PrintDefaults()
+		fmt.Println("Available commands:")
+		fmt.Println("  rekey\tRe-encrypt all files with a new vault password")
+		fmt.Println("  grant\tAdd a recipient and re-encrypt all files for them")
+		fmt.Println("  revoke\tRemove a recipient and re-encrypt all files with a fresh key")
+		fmt.Println("  keygen\tGenerate a random vault key or an identity")
+		fmt.Println("  key\tSplit the vault key into shares, or combine shares back into it")
+		fmt.Println("  agent\tKeep unlocked identities in memory for other Shield commands")
+		fmt.Println("  mv\tMove an encrypted file and re-encrypt it for its new path")
+		fmt.Println("  ansible\tImport Ansible Vault files into Shield, or export Shield files to Ansible Vault")
 	}
 }
 
@@ -213,14 +240,40 @@ func SetDirectory(dir string) {
 }
 
 func SetEncryptionTag() {
+	if Encryption == "" {
+		Encryption = CurrentEncryption
+	}
 	EncryptionTag = "SHIELD[" + Encryption + "]:"
-	EncryptionTagBytes = len(EncryptionTag)
 }
 
 func SetPasswordFile(file string) {
 	VaultPasswordFile = file
 }
 
+func SetVaultPassword(secret []byte) {
+	VaultPassword = secret
+}
+
+func SetCredentialHelper(name string) {
+	CredentialHelper = name
+}
+
+func SetEnvironment(name string) {
+	Environment = name
+}
+
+func SetKeyringDirectory(dir string) {
+	KeyringDirectory = dir
+}
+
+func SetIdentityFiles(files []string) {
+	IdentityFiles = files
+}
+
+func SetCipherName(name string) {
+	CipherName = name
+}
+
 func handleInstall() {
 	err := installShield()
 	if err != nil {
@@ -231,11 +284,13 @@ func handleInstall() {
 }
 
 func handleEncryption() {
+	resolveVaultPassword()
 	colorPrint(Green, "Encrypting files...")
 	encryptFiles()
 }
 
 func handleDecryption() {
+	resolveVaultPassword()
 	colorPrint(Yellow, "Decrypting files...")
 	decryptFiles()
 }
@@ -266,10 +321,108 @@ func handleDefault() {
 func getVaultPasswordFile() string {
 	home := getHomeDirectory()
 
-	if passwordFile == "" {
-		return filepath.Join(home, ".ssh", "vault")
+	if passwordFile != "" {
+		return passwordFile
+	}
+	if file := os.Getenv(PasswordFileEnv); file != "" {
+		return file
 	}
-	return passwordFile
+	return filepath.Join(home, ".ssh", "vault")
+}
+
+// getVaultPassword returns the vault password from stdin, a password command,
+// the credential helper or the environment, in that order, or nil to read
+// VaultPasswordFile. The password is never passed on a command line, where
+// other users could see it.
+func getVaultPassword() ([]byte, error) {
+	if passwordStdin {
+		password, err := readPassword(os.Stdin)
+		if err != nil {
+			return nil, fmt.Errorf("error reading password from stdin: %v", err)
+		}
+		if len(password) == 0 {
+			return nil, errors.New("no password on stdin")
+		}
+		return password, nil
+	}
+
+	if passwordCommand != "" {
+		return runPasswordCommand(passwordCommand)
+	}
+
+	if CredentialHelper != "" {
+		password, err := getCredential("vault")
+		if err != nil || password != nil {
+			return password, err
+		}
+	}
+
+	if password := os.Getenv(PasswordEnv); password != "" {
+		// Keep the password out of the environment of git and any other
+		// command Shield runs.
+		os.Unsetenv(PasswordEnv)
+		return []byte(password), nil
+	}
+
+	return nil, nil
+}
+
+var vaultPasswordResolved bool
+
+// resolveVaultPassword sets the vault password from the sources
+// getVaultPassword reads, once. Only commands that encrypt or decrypt call
+// it, so the others leave stdin, the password command, the credential helper
+// and $SHIELD_PASSWORD alone.
+func resolveVaultPassword() {
+	if vaultPasswordResolved {
+		return
+	}
+	vaultPasswordResolved = true
+
+	password, err := getVaultPassword()
+	if err != nil {
+		colorPrint(Red, err.Error())
+		os.Exit(1)
+	}
+	if password != nil {
+		SetVaultPassword(password)
+	}
+}
+
+func getCredentialHelper() string {
+	if credentialHelper == "" {
+		return os.Getenv(CredentialHelperEnv)
+	}
+	return credentialHelper
+}
+
+func getCipherName() string {
+	if cipherName == "" {
+		return os.Getenv(CipherEnv)
+	}
+	return cipherName
+}
+
+func getKeyringDirectory() string {
+	home := getHomeDirectory()
+
+	if keyringDirectory == "" {
+		return filepath.Join(home, ".ssh", "vault.d")
+	}
+	return keyringDirectory
+}
+
+func getIdentityFiles() []string {
+	home := getHomeDirectory()
+
+	if identityFile == "" {
+		return []string{
+			filepath.Join(home, ".ssh", "shield_identity"),
+			filepath.Join(home, ".ssh", "id_ed25519"),
+			filepath.Join(home, ".ssh", "id_rsa"),
+		}
+	}
+	return []string{identityFile}
 }
 
 func getHomeDirectory() string {
@@ -299,6 +452,15 @@ func main() {
 	SetDirectory(directory)
 	SetEncryptionTag()
 	SetPasswordFile(getVaultPasswordFile())
+	SetCredentialHelper(getCredentialHelper())
+	SetEnvironment(environmentName)
+	SetKeyringDirectory(getKeyringDirectory())
+	SetIdentityFiles(getIdentityFiles())
+	SetCipherName(getCipherName())
+	if _, ok := aeads[CipherName]; CipherName != "" && !ok {
+		colorPrint(Red, fmt.Sprintf("Unknown cipher: %s", CipherName))
+		os.Exit(1)
+	}
 
 	if encrypt {
 		handleEncryption()
@@ -320,11 +482,41 @@ func main() {
 		handleVersion()
 	}
 
+	if flag.NArg() > 0 {
+		handleCommand(flag.Arg(0), flag.Args()[1:])
+	}
+
 	if !encrypt && !decrypt && !generateHook && !version && !install {
 		handleDefault()
 	}
 }
 
+func handleCommand(name string, args []string) {
+	switch name {
+	case "rekey":
+		handleRekey(args)
+	case "grant":
+		handleGrant(args)
+	case "revoke":
+		handleRevoke(args)
+	case "keygen":
+		handleKeygen(args)
+	case "key":
+		handleKey(args)
+	case "agent":
+		handleAgent(args)
+	case "mv":
+		handleMove(args)
+	case "ansible":
+		handleAnsible(args)
+	default:
+		colorPrint(Red, fmt.Sprintf("Unknown command: %s", name))
+		flag.Usage()
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
 func getPreCommitScript() string {
 	switch runtime.GOOS {
 	case "windows":
@@ -436,26 +628,29 @@ func readPatternsFromFile(file string) ([]string, error) {
 	return patterns, nil
 }
 
-func processFiles(files []string, actionFunc func(string), wg *sync.WaitGroup, semaphore chan struct{}) {
-	for _, path := range files {
+func processFiles(files []shieldFile, actionFunc func(shieldFile), wg *sync.WaitGroup, semaphore chan struct{}) {
+	for _, file := range files {
 		semaphore <- struct{}{}
 		wg.Add(1)
 
-		go func(path string) {
+		go func(file shieldFile) {
 			defer func() {
 				<-semaphore
 				wg.Done()
 			}()
 
-			actionFunc(path)
-		}(path)
+			actionFunc(file)
+		}(file)
 	}
 }
 
-func encryptFiles() {
-	shieldPatterns, err := readPatternsFromFile(".shield")
+// findShieldFiles returns every file matching a pattern in .shield that is not
+// excluded by .shieldignore, whether or not it is currently encrypted. When an
+// environment was selected with --env, only its files are returned.
+func findShieldFiles() []shieldFile {
+	shieldRules, err := readShieldConfig()
 	if err != nil {
-		colorPrint(Red, "Error reading .shield file, please ensure it exists and is correctly formatted.")
+		colorPrint(Red, fmt.Sprintf("Error reading .shield file, please ensure it exists and is correctly formatted: %s", err))
 		os.Exit(1)
 	}
 
@@ -465,11 +660,27 @@ func encryptFiles() {
 		os.Exit(1)
 	}
 
+	if Environment != "" {
+		found := false
+		for _, rule := range shieldRules {
+			found = found || rule.Env.Name == Environment
+		}
+		if !found {
+			colorPrint(Red, fmt.Sprintf("Unknown environment: %s", Environment))
+			os.Exit(1)
+		}
+	}
+
 	fsys := os.DirFS(directory)
-	var filesToEncrypt []string
-	for _, pattern := range shieldPatterns {
-		colorPrint(Green, fmt.Sprintf("Looking for files matching pattern: %s", pattern))
-		matchingFiles, err := doublestar.Glob(fsys, pattern)
+	seen := make(map[string]bool)
+	var files []shieldFile
+	for _, rule := range shieldRules {
+		if Environment != "" && rule.Env.Name != Environment {
+			continue
+		}
+
+		colorPrint(Green, fmt.Sprintf("Looking for files matching pattern: %s", rule.Pattern))
+		matchingFiles, err := doublestar.Glob(fsys, rule.Pattern)
 		if err != nil {
 			colorPrint(Red, fmt.Sprintf("Error while matching glob pattern: %s", err))
 			os.Exit(1)
@@ -484,162 +695,403 @@ func encryptFiles() {
 					break
 				}
 			}
-			if isOmitted {
+			if isOmitted || seen[filePath] {
 				continue
 			}
 
-			encrypted, _ := isFileEncrypted(filePath)
-			if !encrypted {
-				filesToEncrypt = append(filesToEncrypt, filePath)
+			seen[filePath] = true
+			files = append(files, shieldFile{Path: filePath, Env: rule.Env, Options: rule.Options})
+		}
+	}
+
+	return files
+}
+
+func encryptFiles() {
+	filesToEncrypt := make(map[*environment][]shieldFile)
+	for _, file := range findShieldFiles() {
+		needed, err := needsEncryption(file)
+		if err != nil {
+			colorPrint(Red, fmt.Sprintf("Error checking encryption status of %s: %s", file.Path, err))
+			continue
+		}
+		if needed {
+			filesToEncrypt[file.Env] = append(filesToEncrypt[file.Env], file)
+		}
+	}
+	if err := preflightVaultPassword(); err != nil {
+		colorPrint(Red, err.Error())
+		os.Exit(1)
+	}
+
+	keyring, err := loadKeyring()
+	if err != nil {
+		colorPrint(Red, fmt.Sprintf("Error loading keys: %s", err))
+		os.Exit(1)
+	}
+
+	for env := range filesToEncrypt {
+		if env.isDefault() && len(keyring.Recipients) == 0 && vaultPasswordMissing() {
+			if err := promptVaultPassword(keyring, true); err != nil {
+				colorPrint(Red, err.Error())
+				os.Exit(1)
 			}
 		}
 	}
 
 	var wg sync.WaitGroup
 	semaphore := make(chan struct{}, runtime.NumCPU())
-	processFiles(filesToEncrypt, encryptFile, &wg, semaphore)
+	for env, files := range filesToEncrypt {
+		envKeyring, err := environmentKeyring(keyring, env)
+		if err != nil {
+			colorPrint(Red, err.Error())
+			os.Exit(1)
+		}
+		if envKeyring == nil {
+			colorPrint(Yellow, fmt.Sprintf("No key for environment %s, skipping %d file(s)", env.Name, len(files)))
+			continue
+		}
+
+		processFiles(files, func(file shieldFile) { encryptFile(file, envKeyring) }, &wg, semaphore)
+	}
 	wg.Wait()
 }
 
-func decryptFiles() {
-	shieldPatterns, err := readPatternsFromFile(".shield")
+// environmentKeyring returns the keys new files in env are encrypted with:
+// keyring itself for the default environment, and otherwise the environment's
+// own key. It returns nil without an error when that key is not available on
+// this machine.
+func environmentKeyring(keyring *Keyring, env *environment) (*Keyring, error) {
+	if env.isDefault() {
+		if !keyring.canEncrypt() {
+			return nil, fmt.Errorf("No vault password found at %s or in %s, and no recipients in %s", VaultPasswordFile, KeyringDirectory, RecipientsFile)
+		}
+		return keyring, nil
+	}
+
+	password, err := env.password()
 	if err != nil {
-		colorPrint(Red, "Error reading .shield file, please ensure it exists and is correctly formatted.")
+		return nil, fmt.Errorf("Error reading key for environment %s: %v", env.Name, err)
+	}
+	if password == nil {
+		return nil, nil
+	}
+	return &Keyring{Passwords: []*Password{password}}, nil
+}
+
+func decryptFiles() {
+	var filesToDecrypt []shieldFile
+	environments := make(map[*environment]bool)
+	for _, file := range findShieldFiles() {
+		encrypted, _ := file.isEncrypted()
+		if encrypted {
+			filesToDecrypt = append(filesToDecrypt, file)
+			environments[file.Env] = true
+		}
+	}
+	if err := preflightVaultPassword(); err != nil {
+		colorPrint(Red, err.Error())
 		os.Exit(1)
 	}
 
-	shieldIgnorePatterns, err := readPatternsFromFile(".shieldignore")
+	keyring, err := loadKeyring()
 	if err != nil {
-		colorPrint(Red, "Error reading .shieldignore file, please ensure it exists and is correctly formatted.")
+		colorPrint(Red, fmt.Sprintf("Error loading keys: %s", err))
 		os.Exit(1)
 	}
 
-	fsys := os.DirFS(directory)
-	var filesToDecrypt []string
-	for _, pattern := range shieldPatterns {
-		colorPrint(Green, fmt.Sprintf("Looking for files matching pattern: %s", pattern))
-		matchingFiles, err := doublestar.Glob(fsys, pattern)
+	// Files name the key they need, so a single keyring holding every
+	// available environment key can decrypt all of them.
+	for env := range environments {
+		if env.isDefault() {
+			if len(keyring.Identities) == 0 && vaultPasswordMissing() {
+				if err := promptVaultPassword(keyring, false); err != nil {
+					colorPrint(Red, err.Error())
+					os.Exit(1)
+				}
+			}
+			continue
+		}
+		password, err := env.password()
 		if err != nil {
-			colorPrint(Red, fmt.Sprintf("Error while matching glob pattern: %s", err))
+			colorPrint(Red, fmt.Sprintf("Error reading key for environment %s: %s", env.Name, err))
 			os.Exit(1)
 		}
-
-		for _, filePath := range matchingFiles {
-			isOmitted := false
-			for _, omitPattern := range shieldIgnorePatterns {
-				matches, _ := doublestar.Match(omitPattern, filePath)
-				if matches {
-					isOmitted = true
-					break
-				}
-			}
-			if isOmitted {
-				continue
-			}
-
-			encrypted, _ := isFileEncrypted(filePath)
-			if encrypted {
-				filesToDecrypt = append(filesToDecrypt, filePath)
-			}
+		if password != nil {
+			keyring.Passwords = append(keyring.Passwords, password)
 		}
 	}
 
+	if !keyring.canDecrypt() {
+		colorPrint(Red, fmt.Sprintf("No vault password found at %s or in %s, and no identity found at %s", VaultPasswordFile, KeyringDirectory, strings.Join(IdentityFiles, ", ")))
+		os.Exit(1)
+	}
+
 	var wg sync.WaitGroup
 	semaphore := make(chan struct{}, runtime.NumCPU())
-	processFiles(filesToDecrypt, decryptFile, &wg, semaphore)
+	processFiles(filesToDecrypt, func(file shieldFile) { decryptFile(file, keyring) }, &wg, semaphore)
 	wg.Wait()
 }
 
-func encryptFile(path string) {
-	path = filepath.Join(directory, path)
+func encryptFile(file shieldFile, keyring *Keyring) {
+	path := filepath.Join(directory, file.Path)
 	colorPrint(Yellow, fmt.Sprintf("Attempting to encrypt file: %s", path))
 
-	cmd := exec.Command("openssl", "enc", "-aes-256-cbc", "-nosalt", "-pass", fmt.Sprintf("file:%s", VaultPasswordFile), "-in", path, "-out", path+".enc")
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	err := cmd.Run()
+	if c, ok := fileStreamer(file, Encryption); ok {
+		if err := encryptFileStream(path, c, keyring, file.encryptOptions()); err != nil {
+			colorPrint(Red, fmt.Sprintf("Failed to encrypt file: %s", err))
+			return
+		}
+		colorPrint(Green, fmt.Sprintf("Encrypted file: %s", path))
+		return
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		colorPrint(Red, fmt.Sprintf("Failed to read file: %s", err))
+		return
+	}
+
+	encrypted, err := encryptFileContent(content, file, keyring)
 	if err != nil {
 		colorPrint(Red, fmt.Sprintf("Failed to encrypt file: %s", err))
-	} else {
-		err = addEncryptionTag(path + ".enc") // add tag to encrypted file
-		if err != nil {
-			colorPrint(Red, fmt.Sprintf("Failed to add encryption tag: %s", err))
-			if err := os.Remove(path + ".enc"); err != nil { // remove failed encrypted file
-				colorPrint(Red, fmt.Sprintf("Failed to remove file: %s", err))
-			}
-		} else {
-			colorPrint(Green, fmt.Sprintf("Encrypted file: %s", path))
-			if err := os.Remove(path); err != nil {
-				colorPrint(Red, fmt.Sprintf("Failed to remove original file: %s", err))
-			}
-			if err := os.Rename(path+".enc", path); err != nil {
-				colorPrint(Red, fmt.Sprintf("Failed to rename encrypted file: %s", err))
-			}
-		}
+		return
 	}
+
+	if err := writeFileAtomic(path, encrypted); err != nil {
+		colorPrint(Red, fmt.Sprintf("Failed to write encrypted file: %s", err))
+		return
+	}
+	colorPrint(Green, fmt.Sprintf("Encrypted file: %s", path))
 }
 
-func decryptFile(path string) {
-	path = filepath.Join(directory, path)
+func decryptFile(file shieldFile, keyring *Keyring) {
+	path := filepath.Join(directory, file.Path)
 	colorPrint(Yellow, fmt.Sprintf("Attempting to decrypt file: %s", path))
 
-	err := removeEncryptionTag(path) // remove tag before decryption
+	head, err := readFileHead(path)
 	if err != nil {
-		colorPrint(Red, fmt.Sprintf("Failed to remove encryption tag: %s", err))
-	} else {
-		cmd := exec.Command("openssl", "enc", "-d", "-aes-256-cbc", "-nosalt", "-pass", fmt.Sprintf("file:%s", VaultPasswordFile), "-in", path, "-out", path+".dec")
-		var out bytes.Buffer
-		cmd.Stdout = &out
-		err = cmd.Run()
+		colorPrint(Red, fmt.Sprintf("Failed to read file: %s", err))
+		return
+	}
+	if c, ok := streamedCipher(head); ok {
+		err := decryptFileStream(path, c, keyring, filepath.ToSlash(file.Path))
+		if errors.Is(err, errNoKey) {
+			colorPrint(Yellow, fmt.Sprintf("Skipped file %s: %s", path, err))
+			return
+		}
 		if err != nil {
 			colorPrint(Red, fmt.Sprintf("Failed to decrypt file: %s", err))
-			if err := addEncryptionTag(path); err != nil { // add tag back if decryption failed
-				colorPrint(Red, fmt.Sprintf("Failed to add encryption tag: %s", err))
-			}
-		} else {
-			colorPrint(Green, fmt.Sprintf("Decrypted file: %s", path))
-			if err := os.Remove(path); err != nil {
-				colorPrint(Red, fmt.Sprintf("Failed to remove encrypted file: %s", err))
-			}
-			if err := os.Rename(path+".dec", path); err != nil {
-				colorPrint(Red, fmt.Sprintf("Failed to rename decrypted file: %s", err))
-			}
+			return
 		}
+		colorPrint(Green, fmt.Sprintf("Decrypted file: %s", path))
+		return
 	}
-}
 
-func addEncryptionTag(path string) error {
 	content, err := os.ReadFile(path)
 	if err != nil {
-		return err
+		colorPrint(Red, fmt.Sprintf("Failed to read file: %s", err))
+		return
+	}
+
+	decrypted, err := decryptFileContent(content, file, keyring)
+	if errors.Is(err, errNoKey) {
+		colorPrint(Yellow, fmt.Sprintf("Skipped file %s: %s", path, err))
+		return
+	}
+	if err != nil {
+		colorPrint(Red, fmt.Sprintf("Failed to decrypt file: %s", err))
+		return
+	}
+
+	if err := writeFileAtomic(path, decrypted); err != nil {
+		colorPrint(Red, fmt.Sprintf("Failed to write decrypted file: %s", err))
+		return
+	}
+	colorPrint(Green, fmt.Sprintf("Decrypted file: %s", path))
+}
+
+// encryptFileContent encrypts a file as a whole, or value by value when its
+// pattern sets a mode.
+func encryptFileContent(content []byte, file shieldFile, keyring *Keyring) ([]byte, error) {
+	if file.Options.Mode != "" {
+		return encryptFields(content, file.Options.Mode, keyring, file.encryptOptions())
 	}
 
-	content = append([]byte(EncryptionTag), content...)
+	encrypted, err := encryptContentWith(content, keyring, file.encryptOptions())
+	if err != nil || !file.Options.Armor {
+		return encrypted, err
+	}
+	return armor(encrypted), nil
+}
 
-	return os.WriteFile(path, content, 0666)
+// decryptFileContent reverses encryptFileContent. Armored and raw files are
+// told apart by their content, and a file that was encrypted as a whole before
+// its pattern set a mode is still decrypted as a whole.
+func decryptFileContent(content []byte, file shieldFile, keyring *Keyring) ([]byte, error) {
+	return decryptFileContentAt(content, file, keyring, filepath.ToSlash(file.Path))
 }
 
-func removeEncryptionTag(path string) error {
-	content, err := os.ReadFile(path)
+// decryptFileContentAt is decryptFileContent for a file that was encrypted
+// for path, which differs from file.Path when it was moved.
+func decryptFileContentAt(content []byte, file shieldFile, keyring *Keyring, path string) ([]byte, error) {
+	if isArmored(content) {
+		dearmored, err := dearmor(content)
+		if err != nil {
+			return nil, err
+		}
+		return decryptContentAt(dearmored, keyring, path)
+	}
+	if _, _, ok := parseEncryptionTag(content); ok || file.Options.Mode == "" {
+		return decryptContentAt(content, keyring, path)
+	}
+	return decryptFields(content, file.Options.Mode, keyring, path)
+}
+
+// encryptContentWith encrypts content with the current encryption version,
+// or deterministicVersion for deterministic files, and prefixes it with the
+// matching tag.
+func encryptContentWith(content []byte, keyring *Keyring, opts encryptOptions) ([]byte, error) {
+	version := Encryption
+	if opts.deterministic {
+		version = deterministicVersion
+	}
+	c, err := getCipher(version)
+	if err != nil {
+		return nil, err
+	}
+
+	var encrypted []byte
+	switch c := c.(type) {
+	case aeadCipher:
+		encrypted, err = c.encrypt(content, keyring, opts)
+	case streamer:
+		var buf bytes.Buffer
+		err = c.EncryptStream(&buf, bytes.NewReader(content), keyring, opts)
+		encrypted = buf.Bytes()
+	default:
+		if opts.compression != "" || opts.cipher != "" {
+			return nil, fmt.Errorf("encryption version %s cannot compress or choose a cipher", version)
+		}
+		// Versions without a header have nowhere to record the path.
+		encrypted, err = c.Encrypt(content, keyring)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte("SHIELD["+version+"]:"), encrypted...), nil
+}
+
+// decryptContentAt decrypts tagged content with the cipher for the version
+// named in its tag. The content must have been encrypted for path, or for no
+// path in particular.
+func decryptContentAt(content []byte, keyring *Keyring, path string) ([]byte, error) {
+	version, ciphertext, ok := parseEncryptionTag(content)
+	if !ok {
+		return nil, errors.New("missing encryption tag")
+	}
+
+	c, err := getCipher(version)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	switch c := c.(type) {
+	case aeadCipher:
+		return c.decrypt(ciphertext, keyring, path)
+	case streamer:
+		var buf bytes.Buffer
+		if err := c.DecryptStream(&buf, bytes.NewReader(ciphertext), keyring, path); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	default:
+		return c.Decrypt(ciphertext, keyring)
 	}
+}
 
-	content = content[EncryptionTagBytes:]
+// parseEncryptionTag splits a SHIELD[version]: tag from the start of content
+// and returns the version and the remaining ciphertext.
+func parseEncryptionTag(content []byte) (string, []byte, bool) {
+	if !bytes.HasPrefix(content, []byte("SHIELD[")) {
+		return "", nil, false
+	}
+
+	// Versions are short, so only look for the end of the tag near the start.
+	head := content
+	if len(head) > 32 {
+		head = head[:32]
+	}
+	end := bytes.Index(head, []byte("]:"))
+	if end < 0 {
+		return "", nil, false
+	}
 
-	return os.WriteFile(path, content, 0666)
+	return string(content[len("SHIELD["):end]), content[end+len("]:"):], true
 }
 
+// isFileEncrypted only reads the start of the file, for a tag or armor.
 func isFileEncrypted(path string) (bool, error) {
-	path = filepath.Join(directory, path)
-	content, err := os.ReadFile(path)
+	return scanFileEncrypted(path, false)
+}
+
+// isEncrypted is isFileEncrypted, but files whose pattern sets a mode are
+// also scanned for the tokens of values encrypted in place, without loading
+// them into memory.
+func (f shieldFile) isEncrypted() (bool, error) {
+	return scanFileEncrypted(f.Path, f.Options.Mode != "")
+}
+
+func scanFileEncrypted(path string, fields bool) (bool, error) {
+	f, err := os.Open(filepath.Join(directory, path))
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	head, err := readHead(f)
+	if err != nil {
+		return false, err
+	}
+
+	// Any SHIELD[x]: tag counts, so files written by an older or newer
+	// encryption version are never encrypted twice.
+	if _, _, ok := parseEncryptionTag(head); ok || isArmored(head) {
+		return true, nil
+	}
+	if !fields {
+		return false, nil
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	return fieldTokenPattern.MatchReader(bufio.NewReader(f)), nil
+}
+
+// needsEncryption reports whether a file has plaintext that encryptFile
+// would encrypt. A file encrypted value by value needs it again when values
+// were added since.
+func needsEncryption(file shieldFile) (bool, error) {
+	path := filepath.Join(directory, file.Path)
+	head, err := readFileHead(path)
 	if err != nil {
 		return false, err
 	}
 
-	if len(content) >= EncryptionTagBytes && string(content[:EncryptionTagBytes]) == EncryptionTag {
+	// Ansible Vault files are left for shield ansible import, rather than
+	// encrypted twice.
+	if _, _, ok := parseEncryptionTag(head); ok || isArmored(head) || isAnsibleVault(head) {
+		return false, nil
+	}
+	if file.Options.Mode == "" {
 		return true, nil
 	}
 
-	return false, nil
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	return fieldsNeedEncryption(content, file.Options.Mode)
 }
@@ -37,7 +37,7 @@ func TestShield(t *testing.T) {
 		t.Logf("Created: %s", fullPath)
 	}
 
-	err := os.WriteFile(filepath.Join(tmpDir, ".shieldpass"), []byte("broy"), os.ModePerm)
+	err := os.WriteFile(filepath.Join(tmpDir, ".shieldpass"), []byte("broy"), 0600)
 	if err != nil {
 		t.Errorf("Error writing .shield file: %v", err)
 	}
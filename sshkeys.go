@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/ssh"
+)
+
+// SSH keys are used as recipients the same way age does: ed25519 keys are
+// converted to their X25519 equivalent and used for Diffie-Hellman, and RSA
+// keys wrap the file key directly with RSA-OAEP.
+
+const rsaOAEPLabel = "shield file key"
+
+// errPassphraseProtected is returned for SSH keys that need a passphrase.
+// They can only be used through shield agent, which asks for it once.
+var errPassphraseProtected = errors.New("passphrase protected keys must be added to shield agent")
+
+type sshEd25519Recipient struct {
+	id        string
+	publicKey []byte
+}
+
+type sshEd25519Identity struct {
+	id        string
+	secretKey []byte
+	publicKey []byte
+}
+
+type sshRSARecipient struct {
+	id        string
+	publicKey *rsa.PublicKey
+}
+
+type sshRSAIdentity struct {
+	id         string
+	privateKey *rsa.PrivateKey
+}
+
+// parseSSHRecipient parses a public key in authorized_keys form.
+func parseSSHRecipient(keyType, encoded string) (Recipient, error) {
+	pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(keyType + " " + encoded))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s public key: %v", keyType, err)
+	}
+
+	cryptoKey, ok := pk.(ssh.CryptoPublicKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type: %q", keyType)
+	}
+
+	switch key := cryptoKey.CryptoPublicKey().(type) {
+	case ed25519.PublicKey:
+		publicKey, err := ed25519PublicKeyToCurve25519(key)
+		if err != nil {
+			return nil, err
+		}
+		return &sshEd25519Recipient{id: recipientID(pk.Type(), pk.Marshal()), publicKey: publicKey}, nil
+	case *rsa.PublicKey:
+		if key.N.BitLen() < 2048 {
+			return nil, errors.New("RSA keys must be at least 2048 bits")
+		}
+		return &sshRSARecipient{id: recipientID(pk.Type(), pk.Marshal()), publicKey: key}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type: %q", keyType)
+	}
+}
+
+// parseSSHIdentity parses an unencrypted OpenSSH or PEM private key.
+func parseSSHIdentity(pemBytes []byte) (Identity, error) {
+	key, err := ssh.ParseRawPrivateKey(pemBytes)
+	if err != nil {
+		var missing *ssh.PassphraseMissingError
+		if errors.As(err, &missing) {
+			return nil, errPassphraseProtected
+		}
+		return nil, err
+	}
+
+	return newSSHIdentity(key)
+}
+
+func newSSHIdentity(key interface{}) (Identity, error) {
+	switch key := key.(type) {
+	case *ed25519.PrivateKey:
+		return newSSHIdentity(*key)
+	case ed25519.PrivateKey:
+		pk, err := ssh.NewPublicKey(key.Public())
+		if err != nil {
+			return nil, err
+		}
+		publicKey, err := ed25519PublicKeyToCurve25519(key.Public().(ed25519.PublicKey))
+		if err != nil {
+			return nil, err
+		}
+		return &sshEd25519Identity{
+			id:        recipientID(pk.Type(), pk.Marshal()),
+			secretKey: ed25519PrivateKeyToCurve25519(key),
+			publicKey: publicKey,
+		}, nil
+	case *rsa.PrivateKey:
+		pk, err := ssh.NewPublicKey(&key.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		return &sshRSAIdentity{id: recipientID(pk.Type(), pk.Marshal()), privateKey: key}, nil
+	default:
+		return nil, fmt.Errorf("unsupported private key type: %T", key)
+	}
+}
+
+func (r *sshEd25519Recipient) Wrap(fileKey []byte) (stanza, error) {
+	s, err := (&x25519Recipient{publicKey: r.publicKey}).Wrap(fileKey)
+	if err != nil {
+		return stanza{}, err
+	}
+	s.Type = "ssh-ed25519"
+	s.ID = r.id
+	return s, nil
+}
+
+func (i *sshEd25519Identity) Unwrap(s stanza) ([]byte, error) {
+	if s.Type != "ssh-ed25519" || s.ID != i.id {
+		return nil, errIncorrectIdentity
+	}
+
+	shared, err := curve25519.X25519(i.secretKey, s.Ephemeral)
+	if err != nil {
+		return nil, err
+	}
+
+	return openFileKey(shared, s.Ephemeral, i.publicKey, s.Key)
+}
+
+func (r *sshRSARecipient) Wrap(fileKey []byte) (stanza, error) {
+	wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, r.publicKey, fileKey, []byte(rsaOAEPLabel))
+	if err != nil {
+		return stanza{}, err
+	}
+	return stanza{Type: "ssh-rsa", ID: r.id, Key: wrapped}, nil
+}
+
+func (i *sshRSAIdentity) Unwrap(s stanza) ([]byte, error) {
+	if s.Type != "ssh-rsa" || s.ID != i.id {
+		return nil, errIncorrectIdentity
+	}
+
+	fileKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, i.privateKey, s.Key, []byte(rsaOAEPLabel))
+	if err != nil {
+		return nil, errors.New("failed to unwrap file key")
+	}
+	return fileKey, nil
+}
+
+var curve25519P, _ = new(big.Int).SetString("57896044618658097711785492504343953926634992332820282019728792003956564819949", 10)
+
+// ed25519PublicKeyToCurve25519 maps an Edwards point to its Montgomery form
+// with the birational map u = (1 + y) / (1 - y).
+func ed25519PublicKeyToCurve25519(pk ed25519.PublicKey) ([]byte, error) {
+	if len(pk) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid ed25519 public key")
+	}
+
+	// Keys are little-endian with the sign of x in the top bit.
+	yBytes := make([]byte, 32)
+	for i, b := range pk {
+		yBytes[31-i] = b
+	}
+	yBytes[0] &= 0x7f
+	y := new(big.Int).SetBytes(yBytes)
+	if y.Cmp(curve25519P) >= 0 {
+		return nil, errors.New("invalid ed25519 public key")
+	}
+
+	one := big.NewInt(1)
+	denominator := new(big.Int).Sub(one, y)
+	denominator.Mod(denominator, curve25519P)
+	if denominator.Sign() == 0 {
+		return nil, errors.New("invalid ed25519 public key")
+	}
+	denominator.ModInverse(denominator, curve25519P)
+
+	u := new(big.Int).Add(one, y)
+	u.Mul(u, denominator)
+	u.Mod(u, curve25519P)
+
+	uBytes := u.FillBytes(make([]byte, 32))
+	out := make([]byte, 32)
+	for i, b := range uBytes {
+		out[31-i] = b
+	}
+	return out, nil
+}
+
+// ed25519PrivateKeyToCurve25519 returns the X25519 scalar that matches an
+// ed25519 private key. X25519 clamps the scalar itself.
+func ed25519PrivateKeyToCurve25519(key ed25519.PrivateKey) []byte {
+	h := sha512.Sum512(key.Seed())
+	return h[:curve25519.ScalarSize]
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSSHRecipients(t *testing.T) {
+	Encryption = "2.0"
+	SetEncryptionTag()
+
+	tmpDir := t.TempDir()
+	SetDirectory(tmpDir)
+
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var recipients strings.Builder
+	identityFiles := map[string]string{}
+	for name, key := range map[string]crypto.Signer{"alice": edKey, "bob": rsaKey} {
+		pk, err := ssh.NewPublicKey(key.Public())
+		if err != nil {
+			t.Fatal(err)
+		}
+		recipients.WriteString(name + " " + string(ssh.MarshalAuthorizedKey(pk)))
+
+		block, err := ssh.MarshalPrivateKey(key, name+"@laptop")
+		if err != nil {
+			t.Fatal(err)
+		}
+		identityFiles[name] = filepath.Join(tmpDir, "id_"+name)
+		os.WriteFile(identityFiles[name], pem.EncodeToMemory(block), 0600)
+	}
+	os.WriteFile(filepath.Join(tmpDir, RecipientsFile), []byte(recipients.String()), 0644)
+
+	keyring, err := loadKeyring()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keyring.Recipients) != 2 {
+		t.Fatalf("loaded %d recipients, want 2", len(keyring.Recipients))
+	}
+
+	plaintext := []byte("shared secret")
+	encrypted, err := encryptContent(plaintext, keyring)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, file := range identityFiles {
+		identities, err := readIdentityFile(file)
+		if err != nil {
+			t.Fatalf("failed to read %s's identity: %v", name, err)
+		}
+
+		decrypted, err := decryptContent(encrypted, &Keyring{Identities: identities})
+		if err != nil {
+			t.Errorf("%s failed to decrypt: %v", name, err)
+		} else if !bytes.Equal(decrypted, plaintext) {
+			t.Errorf("%s decrypted %q, want %q", name, decrypted, plaintext)
+		}
+	}
+
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	other, _ := newSSHIdentity(otherKey)
+	if _, err := decryptContent(encrypted, &Keyring{Identities: []Identity{other}}); err == nil {
+		t.Error("a non-recipient ssh key was able to decrypt")
+	}
+}
+
+func TestEd25519ToCurve25519(t *testing.T) {
+	for i := 0; i < 16; i++ {
+		publicKey, privateKey, _ := ed25519.GenerateKey(rand.Reader)
+
+		converted, err := ed25519PublicKeyToCurve25519(publicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected, _ := curve25519.X25519(ed25519PrivateKeyToCurve25519(privateKey), curve25519.Basepoint)
+		if !bytes.Equal(converted, expected) {
+			t.Fatalf("converted public key %x does not match private key %x", converted, expected)
+		}
+	}
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// streamCipher writes SHIELD[3.0] files: the JSON header line of the 2.0
+// format followed by the plaintext in segments, each sealed on its own with
+// the cipher named in the header, as in the STREAM construction. A segment's
+// nonce is a random prefix from the header, the segment number and a flag set
+// only on the last segment, so segments cannot be reordered, dropped or cut
+// off without decryption failing. Files of any size are encrypted and
+// decrypted one segment at a time.
+type streamCipher struct {
+	version string
+}
+
+const (
+	// defaultSegmentSize is the plaintext size of every segment but the last.
+	defaultSegmentSize = 64 * 1024
+	maxSegmentSize     = 16 * 1024 * 1024
+
+	// streamNonceSuffix is the size of the segment number and last flag that
+	// follow the prefix in a segment's nonce.
+	streamNonceSuffix = 5
+	// maxHeaderSize bounds the header line, which grows with the number of
+	// recipients.
+	maxHeaderSize = 1024 * 1024
+)
+
+// streamer is implemented by ciphers that can encrypt and decrypt without
+// holding the whole file in memory. The encryption tag is handled by the
+// caller, as with Cipher. Content is compressed first when opts name one of
+// compressions and it does not look compressed already. DecryptStream fails
+// when the file was encrypted for a path other than path, unless path is
+// empty.
+type streamer interface {
+	EncryptStream(dst io.Writer, src io.Reader, keyring *Keyring, opts encryptOptions) error
+	DecryptStream(dst io.Writer, src io.Reader, keyring *Keyring, path string) error
+}
+
+func (c streamCipher) Encrypt(plaintext []byte, keyring *Keyring) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := c.EncryptStream(&buf, bytes.NewReader(plaintext), keyring, encryptOptions{}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c streamCipher) Decrypt(ciphertext []byte, keyring *Keyring) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := c.DecryptStream(&buf, bytes.NewReader(ciphertext), keyring, ""); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c streamCipher) EncryptStream(dst io.Writer, src io.Reader, keyring *Keyring, opts encryptOptions) error {
+	if opts.deterministic {
+		return errors.New("deterministic files cannot be streamed")
+	}
+
+	reader := bufio.NewReader(src)
+	head, err := reader.Peek(fileHeadSize)
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	header := fileHeader{
+		Version:     c.version,
+		Cipher:      opts.cipherName(),
+		Path:        opts.path,
+		Segment:     defaultSegmentSize,
+		Compression: chooseCompression(opts.compression, head),
+	}
+	if err := checkCipher(header); err != nil {
+		return err
+	}
+
+	key, err := newFileKey(&header, keyring, opts)
+	if err != nil {
+		return err
+	}
+	aead, err := newAEAD(header.Cipher, key)
+	if err != nil {
+		return err
+	}
+	header.Nonce = make([]byte, aead.NonceSize()-streamNonceSuffix)
+	if _, err := rand.Read(header.Nonce); err != nil {
+		return err
+	}
+
+	encodedHeader, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+	encodedHeader = append(encodedHeader, '\n')
+	if _, err := dst.Write(encodedHeader); err != nil {
+		return err
+	}
+
+	segments := &segmentWriter{
+		dst:       dst,
+		stream:    &segmentStream{aead: aead, prefix: header.Nonce, additionalData: c.additionalData(encodedHeader)},
+		plaintext: make([]byte, 0, header.Segment),
+	}
+
+	var w io.WriteCloser = segments
+	if header.Compression != "" {
+		compressor, err := getCompression(header.Compression)
+		if err != nil {
+			return err
+		}
+		if w, err = compressor.newWriter(segments); err != nil {
+			return err
+		}
+	}
+
+	if _, err := io.Copy(w, reader); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return segments.Close()
+}
+
+func (c streamCipher) DecryptStream(dst io.Writer, src io.Reader, keyring *Keyring, path string) error {
+	reader := bufio.NewReader(src)
+	encodedHeader, err := readHeaderLine(reader)
+	if err != nil {
+		return err
+	}
+
+	var header fileHeader
+	if err := json.Unmarshal(encodedHeader, &header); err != nil {
+		return fmt.Errorf("invalid file header: %v", err)
+	}
+	if header.Version != c.version {
+		return fmt.Errorf("file header version %q does not match its tag", header.Version)
+	}
+	if err := checkCipher(header); err != nil {
+		return err
+	}
+	if header.Segment <= 0 || header.Segment > maxSegmentSize {
+		return errors.New("invalid segment size in file header")
+	}
+	if err := checkPath(header, path); err != nil {
+		return err
+	}
+
+	var decompressor compression
+	if header.Compression != "" {
+		if decompressor, err = getCompression(header.Compression); err != nil {
+			return err
+		}
+	}
+
+	key, err := fileKey(header, keyring)
+	if err != nil {
+		return err
+	}
+	aead, err := newAEAD(header.Cipher, key)
+	if err != nil {
+		return err
+	}
+	if len(header.Nonce) != aead.NonceSize()-streamNonceSuffix {
+		return errors.New("invalid nonce in file header")
+	}
+
+	segments := &segmentReader{
+		src:    reader,
+		stream: &segmentStream{aead: aead, prefix: header.Nonce, additionalData: c.additionalData(encodedHeader)},
+		sealed: make([]byte, header.Segment+aead.Overhead()),
+	}
+
+	var r io.Reader = segments
+	if header.Compression != "" {
+		decompressed, err := decompressor.newReader(segments)
+		if err != nil {
+			return fmt.Errorf("failed to decompress: %v", err)
+		}
+		defer decompressed.Close()
+		r = decompressed
+	}
+
+	if _, err := io.Copy(dst, r); err != nil {
+		return err
+	}
+	// Compressed data can end before the last segment was read, so make
+	// sure the whole file authenticated.
+	if !segments.stream.done {
+		if _, err := io.Copy(io.Discard, segments); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c streamCipher) additionalData(encodedHeader []byte) []byte {
+	return append([]byte("SHIELD["+c.version+"]:"), encodedHeader...)
+}
+
+// readHeaderLine reads the header line, newline included.
+func readHeaderLine(reader *bufio.Reader) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > maxHeaderSize {
+			return nil, errors.New("file header is too large")
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF {
+			return nil, errors.New("missing file header")
+		}
+		return line, err
+	}
+}
+
+// segmentStream seals or opens the segments of one file in order.
+type segmentStream struct {
+	aead           cipher.AEAD
+	prefix         []byte
+	additionalData []byte
+	counter        uint32
+	done           bool
+}
+
+func (s *segmentStream) nonce(last bool) ([]byte, error) {
+	if s.done {
+		return nil, errors.New("data after the last segment")
+	}
+	nonce := make([]byte, 0, s.aead.NonceSize())
+	nonce = append(nonce, s.prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, s.counter)
+	if last {
+		nonce = append(nonce, 1)
+	} else {
+		nonce = append(nonce, 0)
+	}
+
+	if s.counter == ^uint32(0) && !last {
+		return nil, errors.New("file is too large")
+	}
+	s.counter++
+	s.done = last
+	return nonce, nil
+}
+
+func (s *segmentStream) seal(dst, plaintext []byte, last bool) ([]byte, error) {
+	nonce, err := s.nonce(last)
+	if err != nil {
+		return nil, err
+	}
+	return s.aead.Seal(dst, nonce, plaintext, s.additionalData), nil
+}
+
+func (s *segmentStream) open(dst, sealed []byte, last bool) ([]byte, error) {
+	nonce, err := s.nonce(last)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := s.aead.Open(dst, nonce, sealed, s.additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("authentication failed in segment %d, the file is corrupt, truncated or the key is wrong", s.counter-1)
+	}
+	return plaintext, nil
+}
+
+// segmentWriter seals what is written to it into segments. A full segment is
+// held back until more is written, since only Close knows which segment is
+// the last.
+type segmentWriter struct {
+	dst       io.Writer
+	stream    *segmentStream
+	plaintext []byte
+	sealed    []byte
+	closed    bool
+}
+
+func (w *segmentWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(w.plaintext) == cap(w.plaintext) {
+			if err := w.flush(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(w.plaintext[len(w.plaintext):cap(w.plaintext)], p)
+		w.plaintext = w.plaintext[:len(w.plaintext)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close seals the last segment. It is safe to call more than once.
+func (w *segmentWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.flush(true)
+}
+
+func (w *segmentWriter) flush(last bool) error {
+	var err error
+	w.sealed, err = w.stream.seal(w.sealed[:0], w.plaintext, last)
+	if err != nil {
+		return err
+	}
+	w.plaintext = w.plaintext[:0]
+	_, err = w.dst.Write(w.sealed)
+	return err
+}
+
+// segmentReader opens segments in order as they are read. A segment is the
+// last one when nothing follows it.
+type segmentReader struct {
+	src       *bufio.Reader
+	stream    *segmentStream
+	sealed    []byte
+	plaintext []byte
+}
+
+func (r *segmentReader) Read(p []byte) (int, error) {
+	for len(r.plaintext) == 0 {
+		if r.stream.done {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plaintext)
+	r.plaintext = r.plaintext[n:]
+	return n, nil
+}
+
+func (r *segmentReader) next() error {
+	n, err := io.ReadFull(r.src, r.sealed)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	last := n < len(r.sealed)
+	if !last {
+		if _, err := r.src.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	r.plaintext, err = r.stream.open(r.plaintext[:0], r.sealed[:n], last)
+	return err
+}
+
+// fileHeadSize is how much of a file is read to find its encryption tag or
+// armor header.
+const fileHeadSize = 512
+
+// readFileHead reads the start of a file.
+func readFileHead(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readHead(f)
+}
+
+func readHead(r io.Reader) ([]byte, error) {
+	head := make([]byte, fileHeadSize)
+	n, err := io.ReadFull(r, head)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return head[:n], err
+}
+
+// fileStreamer returns the streamer that encrypts a file in version, if it is
+// encrypted as a whole without options that need all of it in memory.
+func fileStreamer(file shieldFile, version string) (streamer, bool) {
+	if file.Options.Mode != "" || file.Options.Armor || file.Options.Deterministic {
+		return nil, false
+	}
+	c, ok := ciphers[version].(streamer)
+	return c, ok
+}
+
+// streamedCipher returns the streamer for a file whose tag names a streaming
+// version, given the start of the file.
+func streamedCipher(head []byte) (streamer, bool) {
+	version, _, ok := parseEncryptionTag(head)
+	if !ok {
+		return nil, false
+	}
+	c, ok := ciphers[version].(streamer)
+	return c, ok
+}
+
+// encryptFileStream encrypts the file at path in place, one segment at a time.
+func encryptFileStream(path string, c streamer, keyring *Keyring, opts encryptOptions) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	return writeFileAtomicFunc(path, func(w io.Writer) error {
+		if _, err := io.WriteString(w, EncryptionTag); err != nil {
+			return err
+		}
+		return c.EncryptStream(w, src, keyring, opts)
+	})
+}
+
+// decryptFileStream decrypts the file at path in place, one segment at a time.
+// Nothing is written unless every segment authenticates. The file must have
+// been encrypted for repoPath.
+func decryptFileStream(path string, c streamer, keyring *Keyring, repoPath string) error {
+	src, err := openStreamed(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	return writeFileAtomicFunc(path, func(w io.Writer) error {
+		return c.DecryptStream(w, src, keyring, repoPath)
+	})
+}
+
+// openStreamed opens a file positioned after its encryption tag.
+func openStreamed(path string) (*os.File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	head, err := readHead(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	_, rest, ok := parseEncryptionTag(head)
+	if !ok {
+		f.Close()
+		return nil, errors.New("missing encryption tag")
+	}
+	if _, err := f.Seek(int64(len(head)-len(rest)), io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
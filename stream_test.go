@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStreamCipher(t *testing.T) {
+	defer useCheapKDF()()
+	keyring := passwordKeyring("vault-password")
+	c := streamCipher{version: "3.0"}
+	overhead := 16
+
+	for _, size := range []int{0, 1, defaultSegmentSize - 1, defaultSegmentSize, defaultSegmentSize + 1, 3 * defaultSegmentSize} {
+		plaintext := make([]byte, size)
+		rand.Read(plaintext)
+
+		ciphertext, err := c.Encrypt(plaintext, keyring)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decrypted, err := c.Decrypt(ciphertext, keyring)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(decrypted, plaintext) {
+			t.Fatalf("size %d: decrypted content does not match", size)
+		}
+	}
+
+	plaintext := make([]byte, 3*defaultSegmentSize)
+	ciphertext, _ := c.Encrypt(plaintext, keyring)
+	headerEnd := bytes.IndexByte(ciphertext, '\n') + 1
+	segment := defaultSegmentSize + overhead
+	first, second := ciphertext[headerEnd:headerEnd+segment], ciphertext[headerEnd+segment:headerEnd+2*segment]
+
+	tampered := map[string][]byte{
+		"truncated": ciphertext[:len(ciphertext)-segment],
+		"cut short": ciphertext[:len(ciphertext)-1],
+		"appended":  append(append([]byte{}, ciphertext...), ciphertext[headerEnd:headerEnd+segment]...),
+		"reordered": append(append(append(append([]byte{}, ciphertext[:headerEnd]...), second...), first...), ciphertext[headerEnd+2*segment:]...),
+		"bit flipped": func() []byte {
+			b := append([]byte{}, ciphertext...)
+			b[len(b)-20] ^= 1
+			return b
+		}(),
+	}
+	for name, content := range tampered {
+		if _, err := c.Decrypt(content, keyring); err == nil {
+			t.Errorf("%s: expected decryption to fail", name)
+		}
+	}
+
+	if _, err := c.Decrypt(ciphertext, passwordKeyring("wrong")); err == nil {
+		t.Error("expected decryption with the wrong password to fail")
+	}
+}
+
+func TestStreamFiles(t *testing.T) {
+	defer useCheapKDF()()
+	defer useEncryption("3.0")()
+
+	tmpDir := t.TempDir()
+	SetDirectory(tmpDir)
+	os.WriteFile(filepath.Join(tmpDir, ".shield"), []byte("*.dump\n"), 0644)
+	os.WriteFile(filepath.Join(tmpDir, ".shieldignore"), []byte(""), 0644)
+
+	plaintext := make([]byte, 5*defaultSegmentSize/2)
+	rand.Read(plaintext)
+	path := filepath.Join(tmpDir, "db.dump")
+	os.WriteFile(path, plaintext, 0640)
+
+	oldKeyring, newKeyring := passwordKeyring("old"), passwordKeyring("new")
+	file := shieldFile{Path: "db.dump"}
+	encryptFile(file, oldKeyring)
+
+	content, _ := os.ReadFile(path)
+	if !bytes.HasPrefix(content, []byte("SHIELD[3.0]:")) {
+		t.Fatalf("file was not encrypted with 3.0: %q", content[:32])
+	}
+	if encrypted, _ := file.isEncrypted(); !encrypted {
+		t.Error("expected the file to count as encrypted")
+	}
+
+	// Files encrypted as a whole are told apart by their first bytes alone, so
+	// a token further in does not make a plaintext file count as encrypted.
+	notes := shieldFile{Path: "notes.dump"}
+	os.WriteFile(filepath.Join(tmpDir, notes.Path), []byte("restore with SHIELD[2.0]:c2hpZWxkIHRva2VuIGluIHBsYWlu\n"), 0640)
+	if encrypted, _ := notes.isEncrypted(); encrypted {
+		t.Error("expected a plaintext file containing a token not to count as encrypted")
+	}
+	os.Remove(filepath.Join(tmpDir, notes.Path))
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0640 {
+		t.Errorf("file mode changed to %v", info.Mode().Perm())
+	}
+
+	result := rekeyFiles(findShieldFiles(), oldKeyring, newKeyring)
+	if len(result.rotated) != 1 || len(result.failed) != 0 {
+		t.Fatalf("unexpected rekey result: %+v", result)
+	}
+
+	// A file that fails to decrypt is left untouched.
+	before, _ := os.ReadFile(path)
+	decryptFile(file, oldKeyring)
+	if after, _ := os.ReadFile(path); !bytes.Equal(before, after) {
+		t.Error("failed decryption modified the file")
+	}
+
+	decryptFile(file, newKeyring)
+	if decrypted, _ := os.ReadFile(path); !bytes.Equal(decrypted, plaintext) {
+		t.Error("decrypted file does not match the original")
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func handleGrant(args []string) {
+	if len(args) < 2 {
+		fmt.Println("Usage: shield grant <name> <public key | public key file>")
+		fmt.Println("Adds a recipient and re-encrypts every file matched by .shield for the new list.")
+		os.Exit(1)
+	}
+
+	name := args[0]
+	if strings.HasPrefix(name, "#") {
+		colorPrint(Red, fmt.Sprintf("Invalid recipient name: %s", name))
+		os.Exit(1)
+	}
+
+	fields := strings.Fields(readPublicKeyArgument(args[1:]))
+	if len(fields) < 2 {
+		colorPrint(Red, "Public key must be in the form <key type> <key>")
+		os.Exit(1)
+	}
+	if _, err := parseRecipient(fields[0], fields[1]); err != nil {
+		colorPrint(Red, fmt.Sprintf("Invalid public key: %s", err))
+		os.Exit(1)
+	}
+
+	lines, entries := readRecipientLines()
+	for _, entry := range entries {
+		if entry.Name == name {
+			colorPrint(Red, fmt.Sprintf("%s is already a recipient, revoke them first to change their key", name))
+			os.Exit(1)
+		}
+	}
+	lines = append(lines, name+" "+strings.Join(fields, " "))
+
+	colorPrint(Cyan, fmt.Sprintf("Granting access to %s...", name))
+	updateRecipients(lines)
+}
+
+func handleRevoke(args []string) {
+	if len(args) != 1 {
+		fmt.Println("Usage: shield revoke <name>")
+		fmt.Println("Removes a recipient and re-encrypts every file matched by .shield with a fresh data key.")
+		os.Exit(1)
+	}
+	name := args[0]
+
+	lines, _ := readRecipientLines()
+	var kept []string
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && fields[0] == name {
+			continue
+		}
+		kept = append(kept, line)
+	}
+	if len(kept) == len(lines) {
+		colorPrint(Red, fmt.Sprintf("%s is not a recipient", name))
+		os.Exit(1)
+	}
+
+	colorPrint(Cyan, fmt.Sprintf("Revoking access for %s...", name))
+	updateRecipients(kept)
+}
+
+// readPublicKeyArgument returns the public key given on the command line,
+// either inline or as the path to a .pub file.
+func readPublicKeyArgument(args []string) string {
+	if len(args) == 1 {
+		if content, err := os.ReadFile(args[0]); err == nil {
+			return string(bytes.SplitN(content, []byte("\n"), 2)[0])
+		}
+	}
+	return strings.Join(args, " ")
+}
+
+// readRecipientLines returns the raw lines of the recipients file, including
+// comments, along with the parsed entries.
+func readRecipientLines() ([]string, []recipientEntry) {
+	entries, err := readRecipientsFile()
+	if err != nil && !os.IsNotExist(err) {
+		colorPrint(Red, fmt.Sprintf("Error reading %s: %s", RecipientsFile, err))
+		os.Exit(1)
+	}
+
+	content, err := os.ReadFile(filepath.Join(directory, RecipientsFile))
+	if err != nil && !os.IsNotExist(err) {
+		colorPrint(Red, fmt.Sprintf("Error reading %s: %s", RecipientsFile, err))
+		os.Exit(1)
+	}
+
+	var lines []string
+	if trimmed := strings.TrimRight(string(content), "\n"); trimmed != "" {
+		lines = strings.Split(trimmed, "\n")
+	}
+	return lines, entries
+}
+
+// updateRecipients re-encrypts every file for the recipients in lines, then
+// writes lines to the recipients file. Re-encryption always uses a fresh data
+// key, so a revoked recipient's cached keys are useless. If any file fails the
+// recipients file is left unchanged, so the command can simply be run again.
+func updateRecipients(lines []string) {
+	resolveVaultPassword()
+	if err := preflightVaultPassword(); err != nil {
+		colorPrint(Red, err.Error())
+		os.Exit(1)
+	}
+	keyring, err := loadKeyring()
+	if err != nil {
+		colorPrint(Red, fmt.Sprintf("Error loading keys: %s", err))
+		os.Exit(1)
+	}
+
+	newKeyring := &Keyring{Passwords: keyring.Passwords}
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		entry, err := parseRecipientLine(line)
+		if err != nil {
+			colorPrint(Red, fmt.Sprintf("%s:%d: %s", RecipientsFile, i+1, err))
+			os.Exit(1)
+		}
+		newKeyring.Recipients = append(newKeyring.Recipients, entry.Recipient)
+	}
+
+	if !newKeyring.canEncrypt() {
+		colorPrint(Red, "Cannot remove the last recipient without a vault password to fall back to")
+		os.Exit(1)
+	}
+
+	result := rekeyRecipients(keyring, newKeyring)
+	printRekeySummary(result)
+
+	if len(result.failed) > 0 {
+		colorPrint(Red, fmt.Sprintf("%s was not updated, fix the errors above and run the command again", RecipientsFile))
+		os.Exit(1)
+	}
+
+	content := strings.Join(lines, "\n")
+	if content != "" {
+		content += "\n"
+	}
+	if err := writeFileAtomic(filepath.Join(directory, RecipientsFile), []byte(content)); err != nil {
+		colorPrint(Red, fmt.Sprintf("Error writing %s: %s", RecipientsFile, err))
+		os.Exit(1)
+	}
+	colorPrint(Green, fmt.Sprintf("Updated %s", RecipientsFile))
+}
+
+// rekeyRecipients re-encrypts the default environment's files from the old
+// keyring to the new one. Recipients only apply to the default environment;
+// other environments' keys may be in the keyring too, but their files must
+// stay encrypted with those keys alone. A file left encrypted to the old
+// recipients could still be read by whoever was just revoked, so one that
+// cannot be decrypted with the old keyring is a failure rather than skipped.
+func rekeyRecipients(oldKeyring, newKeyring *Keyring) *rekeyResult {
+	var files []shieldFile
+	for _, file := range findShieldFiles() {
+		if file.Env.isDefault() {
+			files = append(files, file)
+		}
+	}
+
+	result := rekeyFiles(files, oldKeyring, newKeyring)
+	for _, path := range result.locked {
+		result.failed[path] = fmt.Errorf("%v, so it cannot be re-encrypted for the new recipients", errNoKey)
+	}
+	result.locked = nil
+	return result
+}
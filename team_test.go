@@ -0,0 +1,98 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGrantRevoke(t *testing.T) {
+	defer useCheapKDF()()
+	Encryption = "2.0"
+	SetEncryptionTag()
+
+	tmpDir := t.TempDir()
+	SetDirectory(tmpDir)
+
+	os.MkdirAll(filepath.Join(tmpDir, "secrets/prod"), os.ModePerm)
+	os.WriteFile(filepath.Join(tmpDir, "secrets/db.txt"), []byte("hunter2"), 0644)
+	os.WriteFile(filepath.Join(tmpDir, "secrets/prod/db.txt"), []byte("prod-secret"), 0644)
+	os.WriteFile(filepath.Join(tmpDir, ".shield"), []byte("secrets/*.txt\n\n[prod]\nsecrets/prod/*\n"), 0644)
+	os.WriteFile(filepath.Join(tmpDir, ".shieldignore"), []byte(""), 0644)
+	os.WriteFile(filepath.Join(tmpDir, "vault"), []byte("broy"), 0600)
+	SetPasswordFile(filepath.Join(tmpDir, "vault"))
+	SetIdentityFiles(nil)
+	keyringDir := filepath.Join(tmpDir, "vault.d")
+	os.MkdirAll(keyringDir, 0700)
+	os.WriteFile(filepath.Join(keyringDir, "prod"), []byte("prod-password"), 0600)
+	SetKeyringDirectory(keyringDir)
+
+	alice, _ := generateX25519Identity()
+	bob, _ := generateX25519Identity()
+	aliceFile := filepath.Join(tmpDir, "alice.pub")
+	os.WriteFile(aliceFile, []byte(alice.PublicKey()+"\n"), 0644)
+
+	encryptFiles()
+
+	canDecrypt := func(identity Identity) bool {
+		content, _ := os.ReadFile(filepath.Join(tmpDir, "secrets/db.txt"))
+		decrypted, err := decryptContent(content, &Keyring{Identities: []Identity{identity}})
+		return err == nil && string(decrypted) == "hunter2"
+	}
+	canDecryptProd := func(keyring *Keyring) bool {
+		content, _ := os.ReadFile(filepath.Join(tmpDir, "secrets/prod/db.txt"))
+		decrypted, err := decryptContent(content, keyring)
+		return err == nil && string(decrypted) == "prod-secret"
+	}
+
+	// The first grant moves the file from the vault password to recipients.
+	handleGrant([]string{"alice", aliceFile})
+	if !canDecrypt(alice) {
+		t.Error("alice cannot decrypt after being granted access")
+	}
+	// The prod key is in the keyring, but recipients are only for the
+	// default environment.
+	if canDecryptProd(&Keyring{Identities: []Identity{alice}}) {
+		t.Error("alice can decrypt a prod file after being granted access")
+	}
+	if !canDecryptProd(passwordKeyring("prod-password")) {
+		t.Error("the prod file is no longer encrypted with the prod key")
+	}
+
+	SetIdentityFiles([]string{filepath.Join(tmpDir, "alice.key")})
+	os.WriteFile(IdentityFiles[0], []byte(alice.String()), 0600)
+
+	handleGrant(append([]string{"bob"}, strings.Fields(bob.PublicKey())...))
+	if !canDecrypt(alice) || !canDecrypt(bob) {
+		t.Error("alice and bob should both be able to decrypt")
+	}
+
+	handleRevoke([]string{"alice"})
+	if canDecrypt(alice) {
+		t.Error("alice can still decrypt after being revoked")
+	}
+	if !canDecrypt(bob) {
+		t.Error("bob cannot decrypt after alice was revoked")
+	}
+
+	// A default environment file the operator cannot decrypt fails the
+	// update, since it would stay readable by a revoked recipient.
+	os.WriteFile(filepath.Join(tmpDir, "secrets/other.txt"), []byte("other"), 0644)
+	encryptFile(shieldFile{Path: "secrets/other.txt"}, passwordKeyring("other-password"))
+	keyring, err := loadKeyring()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result := rekeyRecipients(keyring, keyring); result.failed["secrets/other.txt"] == nil {
+		t.Errorf("expected a file that cannot be decrypted to fail, got %+v", result)
+	}
+
+	entries, err := readRecipientsFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name != "bob" {
+		t.Errorf("unexpected recipients after revoke: %+v", entries)
+	}
+}